@@ -0,0 +1,98 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/* tls is used for ssl and wss */
+func (m MqttConfig) Secure() bool {
+	return m.Scheme == "ssl" || m.Scheme == "wss"
+}
+
+/* f.e. ssl://broker:8883 or wss://broker:443/mqtt */
+func (m MqttConfig) BrokerURL() string {
+	url := fmt.Sprintf("%s://%s:%d", m.Scheme, m.Broker, m.Port)
+	if m.Scheme == "ws" || m.Scheme == "wss" {
+		url += "/" + strings.TrimPrefix(m.Path, "/")
+	}
+	return url
+}
+
+func (m MqttConfig) Validate() error {
+	if m.Version != 3 && m.Version != 5 {
+		return fmt.Errorf("mqtt: unknown version %d, use 3 or 5", m.Version)
+	}
+	if m.QoS > 2 {
+		return fmt.Errorf("mqtt: qos %d must be 0, 1 or 2", m.QoS)
+	}
+	for _, s := range m.Subscriptions {
+		if s.Topic == "" || s.QoS > 2 {
+			return fmt.Errorf("mqtt: subscription %q needs a topic and qos 0, 1 or 2", s.Topic)
+		}
+	}
+	if strings.ContainsAny(m.Status.Topic, "+#") {
+		return fmt.Errorf("mqtt: status topic %q must not contain wildcards", m.Status.Topic)
+	}
+	if m.ShareGroup != "" && m.Version != 5 {
+		return fmt.Errorf("mqtt: sharegroup needs version 5")
+	}
+	switch m.Scheme {
+	case "tcp", "ssl", "ws", "wss":
+	default:
+		return fmt.Errorf("mqtt: unknown scheme %q, use tcp, ssl, ws or wss", m.Scheme)
+	}
+	if !m.Secure() && (m.CAFile != "" || m.CertFile != "" || m.KeyFile != "") {
+		return fmt.Errorf("mqtt: certificates need scheme ssl or wss, not %s", m.Scheme)
+	}
+	if (m.CertFile == "") != (m.KeyFile == "") {
+		return fmt.Errorf("mqtt: certfile and keyfile have to be set both")
+	}
+	files := map[string]string{"cafile": m.CAFile, "certfile": m.CertFile, "keyfile": m.KeyFile}
+	for name, file := range files {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("mqtt %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+/* tls settings for ssl and wss, nil for plain connections */
+func (m MqttConfig) TLSConfig() (*tls.Config, error) {
+	if !m.Secure() {
+		return nil, nil
+	}
+	conf := &tls.Config{
+		InsecureSkipVerify: m.InsecureSkipVerify,
+		ServerName:         m.ServerName,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = m.Broker
+	}
+
+	if m.CAFile != "" {
+		pem, err := os.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt cafile: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt cafile %s: no PEM certificates found", m.CAFile)
+		}
+	}
+
+	if m.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt certfile %s / keyfile %s: %w", m.CertFile, m.KeyFile, err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
@@ -1,6 +1,10 @@
 package config
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
+
 	"victron_energymeter_mqtt/phase"
 )
 
@@ -12,10 +16,41 @@ type Config struct {
 
 	Logging LogConfig
 	Mqtt    MqttConfig
+	Dbus    DbusConfig
+
+	Factors  FactorConfig
+	Stale    StaleConfig
+	Invert   bool
+	Counters CounterConfig
+	Derive   []string // fields computed from the others if not mapped, default for all phases
+
+	Limits    map[string]LimitConfig // plausibility limits per field, readings outside are dropped
+	Smoothing SmoothingConfig
+
+	Variables map[string]phase.Topic // named MQTT values for expressions, default for all meters
 
-	Factors FactorConfig
+	StateFile string // persistent state like counter offsets, default: /data/victron-mqtt-bridge.state
 
+	// single meter setup, used if no meters are configured
 	Phases []phase.SinglePhase
+
+	Meters []MeterConfig
+}
+
+type MeterConfig struct {
+	Name     string `json:"name"`
+	Topic    string `json:"topic"` // topic root for relative phase topics, default: mqtt topic
+	Dbus     DbusConfig
+	Factors  *FactorConfig  // default: global factors
+	Stale    *StaleConfig   // default: global stale settings
+	Invert   bool           // swap import/export and the sign of power
+	Counters *CounterConfig // default: global counter settings
+	Derive   []string       // default: global derive, can be set per phase as well
+
+	Limits    map[string]LimitConfig // default: global limits
+	Smoothing *SmoothingConfig       // default: global smoothing
+	Variables map[string]phase.Topic // default: global variables
+	Phases    []phase.SinglePhase
 }
 
 type FactorConfig struct {
@@ -23,17 +58,90 @@ type FactorConfig struct {
 	Exported float64
 }
 
+type CounterConfig struct {
+	Tolerance float64 `json:"tolerance"` // kWh an energy counter may go backwards before it counts as reset
+	Rollover  float64 `json:"rollover"`  // kWh at which the counters wrap, 0 if they do not
+}
+
+type LimitConfig struct {
+	Min     *float64 `json:"min"`     // not set: no lower bound
+	Max     *float64 `json:"max"`     // not set: no upper bound
+	MaxRate float64  `json:"maxrate"` // max change per second, 0 disables
+}
+
+type SmoothingConfig struct {
+	Mode   string `json:"mode"`   // median or ema, empty disables
+	Window int    `json:"window"` // number of readings, default 5
+}
+
+type StaleConfig struct {
+	Timeout int      `json:"timeout"` // seconds without new values before the meter is disconnected, 0 disables
+	Fields  []string `json:"fields"`  // fields that have to be fresh for every phase, default: Power
+}
+
 type LogConfig struct {
 	Level    string `json:"level,omitempty"`
 	Interval int    `json:"interval,omitempty"`
 }
 
+type StatusConfig struct {
+	Topic    string `json:"topic"`    // retained online/offline, the heartbeat goes to <topic>/heartbeat. empty disables
+	Interval int    `json:"interval"` // seconds between heartbeats, default: 60
+}
+
+type SubscriptionConfig struct {
+	Topic string `json:"topic"`
+	QoS   byte   `json:"qos"`
+}
+
 type MqttConfig struct {
 	Broker   string `json:"broker"`
 	Port     int    `json:"port"`
 	User     string `json:"user"`
 	Password string `json:"password"`
 	Topic    string `json:"topic"`
+
+	ReconnectInterval int `json:"reconnectinterval"` // max seconds between reconnect attempts
+
+	Subscriptions []SubscriptionConfig `json:"subscriptions"` // default: exactly the topics of all meters
+	QoS           byte                 `json:"qos"`           // QoS of the default subscriptions, default: 1
+
+	Status StatusConfig `json:"status"`
+
+	// transport, see mqtt.go
+	Version            int    `json:"version"`            // protocol: 3 (3.1.1) or 5, default: 3
+	ShareGroup         string `json:"sharegroup"`         // v5 shared subscription group, empty disables
+	Scheme             string `json:"scheme"`             // tcp, ssl, ws or wss, default: tcp
+	Path               string `json:"path"`               // websocket path, f.e. /mqtt
+	CAFile             string `json:"cafile"`             // CA to verify the broker, default: system CAs
+	CertFile           string `json:"certfile"`           // client certificate
+	KeyFile            string `json:"keyfile"`            // key of the client certificate
+	InsecureSkipVerify bool   `json:"insecureskipverify"` // do not verify the broker certificate
+	ServerName         string `json:"servername"`         // SNI and name to verify, default: broker
+}
+
+type DbusConfig struct {
+	Role           string `json:"role"`        // grid, pvinverter, acload, genset, evcharger
+	ServiceName    string `json:"servicename"` // com.victronenergy.<role>.*
+	DeviceInstance int    `json:"deviceinstance"`
+	DeviceType     int    `json:"devicetype"`
+	Serial         string `json:"serial"`
+	ProductId      int    `json:"productid"`
+	ProductName    string `json:"productname"`
+	CustomName     string `json:"customname"`
+
+	Position int     `json:"position"` // 0: AC input 1, 1: AC output, 2: AC input 2
+	MaxPower float64 `json:"maxpower"` // pvinverter only
+}
+
+/* change a setting by its config key, used for values written over the dbus */
+func (d *DbusConfig) Set(key string, value interface{}) {
+	switch key {
+	case "customname":
+		d.CustomName = value.(string)
+	case "position":
+		d.Position = value.(int)
+	}
 }
 
 func NewConfig() *Config {
@@ -52,12 +160,28 @@ func (c *Config) SetDefaults() {
 	c.Factors.Imported = 1
 	c.Factors.Exported = 1
 
+	c.Stale.Timeout = 0 //disabled
+	c.Stale.Fields = []string{"Power"}
+
+	c.Counters.Tolerance = 0.01
+	c.Counters.Rollover = 0
+	c.StateFile = "/data/victron-mqtt-bridge.state"
+
 	//MQTT values
 	c.Mqtt.Broker = "localhost"
 	c.Mqtt.Port = 1883
 	c.Mqtt.Topic = "stromzaehler/#"
 	c.Mqtt.User = ""
 	c.Mqtt.Password = ""
+	c.Mqtt.ReconnectInterval = 60
+	c.Mqtt.Scheme = "tcp"
+	c.Mqtt.Version = 3
+	c.Mqtt.QoS = 1
+
+	//DBUS values, the rest is filled in from the role
+	c.Dbus.Role = "grid"
+	c.Dbus.DeviceInstance = 30
+	c.Dbus.Serial = "BP98305081235"
 }
 
 func (c *Config) FixValues() {
@@ -69,4 +193,197 @@ func (c *Config) FixValues() {
 		c.Logging.Interval = 3600
 	}
 
+	if c.Mqtt.ReconnectInterval <= 0 {
+		c.Mqtt.ReconnectInterval = 60
+	}
+	c.Mqtt.Scheme = strings.ToLower(c.Mqtt.Scheme)
+	if c.Mqtt.Scheme == "" {
+		c.Mqtt.Scheme = "tcp"
+	}
+	if c.Mqtt.Version == 0 {
+		c.Mqtt.Version = 3
+	}
+	if c.Mqtt.Status.Interval <= 0 {
+		c.Mqtt.Status.Interval = 60
+	}
+
+	// old style config with a single meter
+	if len(c.Meters) == 0 {
+		c.Meters = []MeterConfig{{
+			Name:   c.Name,
+			Dbus:   c.Dbus,
+			Invert: c.Invert,
+			Derive: c.Derive,
+			Phases: c.Phases,
+		}}
+	}
+
+	for i := range c.Meters {
+		m := &c.Meters[i]
+		if m.Name == "" {
+			m.Name = fmt.Sprintf("meter%d", i+1)
+		}
+		if m.Topic == "" {
+			m.Topic = phase.TopicRoot(c.Mqtt.Topic)
+		}
+		m.Topic = phase.TopicRoot(m.Topic)
+		if m.Dbus.Role == "" {
+			m.Dbus.Role = "grid"
+		}
+		if m.Dbus.Serial == "" {
+			m.Dbus.Serial = m.Name
+		}
+		if m.Factors == nil {
+			factors := c.Factors
+			m.Factors = &factors
+		}
+		if m.Stale == nil {
+			stale := c.Stale
+			m.Stale = &stale
+		}
+		if m.Counters == nil {
+			counters := c.Counters
+			m.Counters = &counters
+		}
+		if len(m.Stale.Fields) == 0 {
+			m.Stale.Fields = []string{"Power"}
+		}
+		if m.Derive == nil {
+			m.Derive = c.Derive
+		}
+		if m.Limits == nil {
+			m.Limits = c.Limits
+		}
+		m.Limits = fieldNames(m.Limits)
+		if m.Smoothing == nil {
+			smoothing := c.Smoothing
+			m.Smoothing = &smoothing
+		}
+		if m.Smoothing.Window <= 0 {
+			m.Smoothing.Window = 5
+		}
+		for j := range m.Phases {
+			if m.Phases[j].Topic != "" {
+				m.Phases[j].Topic = phase.TopicRoot(m.Phases[j].Topic)
+			}
+			if m.Phases[j].Derive == nil {
+				m.Phases[j].Derive = m.Derive
+			}
+			m.Phases[j].Expressions = expressionFields(m.Phases[j].Expressions)
+		}
+		if m.Variables == nil {
+			m.Variables = c.Variables
+		}
+		variables := make(map[string]phase.Topic, len(m.Variables))
+		for name, t := range m.Variables {
+			variables[strings.ToLower(name)] = t
+		}
+		m.Variables = variables
+	}
+
+}
+
+func (c *Config) Validate() error {
+	if err := c.Mqtt.Validate(); err != nil {
+		return err
+	}
+	instances := make(map[int]string)
+	for _, m := range c.Meters {
+		if m.Dbus.DeviceInstance < 0 {
+			return fmt.Errorf("meter %s: dbus deviceinstance %d must not be negative", m.Name, m.Dbus.DeviceInstance)
+		}
+		if other, ok := instances[m.Dbus.DeviceInstance]; ok {
+			return fmt.Errorf("meter %s: dbus deviceinstance %d already used by meter %s", m.Name, m.Dbus.DeviceInstance, other)
+		}
+		instances[m.Dbus.DeviceInstance] = m.Name
+
+		for _, ph := range m.Phases {
+			if ph.Integrate && (ph.Provides("Imported") || ph.Provides("Exported")) {
+				return fmt.Errorf("meter %s: phase %s integrates power, it can not have imported or exported topics", m.Name, ph.Name)
+			}
+			if ph.Integrate && !ph.Provides("Power") && !ph.Derives("Power") {
+				return fmt.Errorf("meter %s: phase %s integrates power, but has no power topic", m.Name, ph.Name)
+			}
+			topics := reflect.ValueOf(ph.Topics)
+			for i := 0; i < topics.NumField(); i++ {
+				t := topics.Field(i).Interface().(phase.Topic)
+				if _, ok := phase.UnitFactor(t.Unit); t.Unit != "" && !ok {
+					return fmt.Errorf("meter %s: phase %s %s: unknown unit %q", m.Name, ph.Name, topics.Type().Field(i).Name, t.Unit)
+				}
+			}
+			for _, field := range ph.Derive {
+				if !derivable(field) {
+					return fmt.Errorf("meter %s: phase %s can not derive %q, only %v", m.Name, ph.Name, field, phase.DerivableFields)
+				}
+			}
+		}
+		if _, err := phase.Compile(m.Phases, m.Variables); err != nil {
+			return fmt.Errorf("meter %s: %w", m.Name, err)
+		}
+		for name, t := range m.Variables {
+			if _, ok := phase.UnitFactor(t.Unit); t.Unit != "" && !ok {
+				return fmt.Errorf("meter %s: variable %s: unknown unit %q", m.Name, name, t.Unit)
+			}
+		}
+		if m.Counters.Tolerance < 0 || m.Counters.Rollover < 0 {
+			return fmt.Errorf("meter %s: counter tolerance and rollover must not be negative", m.Name)
+		}
+		if m.Stale.Timeout < 0 {
+			return fmt.Errorf("meter %s: stale timeout %d must not be negative", m.Name, m.Stale.Timeout)
+		}
+		topics := reflect.TypeOf(phase.Topics{})
+		for _, field := range m.Stale.Fields {
+			if _, ok := topics.FieldByName(field); !ok {
+				return fmt.Errorf("meter %s: unknown stale field %q", m.Name, field)
+			}
+		}
+		for field, limit := range m.Limits {
+			if _, ok := topics.FieldByName(field); !ok {
+				return fmt.Errorf("meter %s: unknown limits field %q", m.Name, field)
+			}
+			if limit.Min != nil && limit.Max != nil && *limit.Min > *limit.Max {
+				return fmt.Errorf("meter %s: %s limits min %v is above max %v", m.Name, field, *limit.Min, *limit.Max)
+			}
+			if limit.MaxRate < 0 {
+				return fmt.Errorf("meter %s: %s maxrate must not be negative", m.Name, field)
+			}
+		}
+		switch m.Smoothing.Mode {
+		case "", "median", "ema":
+		default:
+			return fmt.Errorf("meter %s: unknown smoothing mode %q, use median or ema", m.Name, m.Smoothing.Mode)
+		}
+	}
+	return nil
+}
+
+func derivable(field string) bool {
+	for _, f := range phase.DerivableFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+/* viper lowercases all keys, map them back to the field names of phase.Topics */
+func fieldNames(limits map[string]LimitConfig) map[string]LimitConfig {
+	named := make(map[string]LimitConfig, len(limits))
+	for key, limit := range limits {
+		key, _ = phase.FieldName(key)
+		named[key] = limit
+	}
+	return named
+}
+
+func expressionFields(expressions map[string]string) map[string]string {
+	if expressions == nil {
+		return nil
+	}
+	named := make(map[string]string, len(expressions))
+	for key, source := range expressions {
+		key, _ = phase.FieldName(key)
+		named[key] = source
+	}
+	return named
 }
@@ -1,36 +1,46 @@
 package dbustools
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
 
+	vc "victron_energymeter_mqtt/config"
+	"victron_energymeter_mqtt/phase"
+
 	"github.com/godbus/dbus/introspect"
 	"github.com/godbus/dbus/v5"
 	log "github.com/sirupsen/logrus"
 )
 
-var conn, _ = dbus.SystemBus()
 var DryRun bool
-var dbusChan chan dbusMsg
 
 type dbusMsg struct {
 	Value float64
 	Path  string
-	Unit  string
 }
 
 type objectpath string
 
-var victronValues = map[int]map[objectpath]dbus.Variant{
-	// 0: This will be used to store the VALUE variant
-	0: map[objectpath]dbus.Variant{},
-	// 1: This will be used to store the STRING variant
-	1: map[objectpath]dbus.Variant{},
+// Service is a single meter on the dbus, with its own connection, name and values
+type Service struct {
+	Identity   vc.DbusConfig
+	Phases     []phase.SinglePhase
+	OnSetValue SetValueHandler
+
+	conn          *dbus.Conn
+	queue         *updateQueue
+	victronValues map[int]map[objectpath]dbus.Variant
+	valuesMutex   sync.RWMutex
+	connected     bool
+}
+
+// busItem is the com.victronenergy.BusItem exported for a single path
+type busItem struct {
+	service *Service
+	path    objectpath
 }
-var victronValuesMutex = &sync.RWMutex{}
 
 const intro = `
 <node>
@@ -50,73 +60,99 @@ const intro = `
     </method>
     </interface>` + introspect.IntrospectDataString + `</node> `
 
-func init() {
-	dbusChan = make(chan dbusMsg)
+func NewService(id vc.DbusConfig, phases []phase.SinglePhase) *Service {
+	return &Service{
+		Identity: id,
+		Phases:   phases,
+		queue:    newUpdateQueue(),
+		victronValues: map[int]map[objectpath]dbus.Variant{
+			// 0: This will be used to store the VALUE variant
+			0: map[objectpath]dbus.Variant{},
+			// 1: This will be used to store the STRING variant
+			1: map[objectpath]dbus.Variant{},
+		},
+		connected: true,
+	}
 }
 
-func (f objectpath) GetValue() (dbus.Variant, *dbus.Error) {
-	log.Debug("GetValue() called for ", f)
-	log.Debug("...returning ", victronValues[0][f])
-	return victronValues[0][f], nil
+func (f busItem) GetValue() (dbus.Variant, *dbus.Error) {
+	f.service.valuesMutex.RLock()
+	value := f.service.victronValues[0][f.path]
+	f.service.valuesMutex.RUnlock()
+	log.Debug("GetValue() called for ", f.path)
+	log.Debug("...returning ", value)
+	return value, nil
 }
-func (f objectpath) GetText() (string, *dbus.Error) {
-	log.Debug("GetText() called for ", f)
-	log.Debug("...returning ", victronValues[1][f])
+func (f busItem) GetText() (string, *dbus.Error) {
+	f.service.valuesMutex.RLock()
+	value := f.service.victronValues[1][f.path]
+	f.service.valuesMutex.RUnlock()
+	log.Debug("GetText() called for ", f.path)
+	log.Debug("...returning ", value)
 	// Why does this end up ""SOMEVAL"" ... trim it I guess
-	return strings.Trim(victronValues[1][f].String(), "\""), nil
+	return strings.Trim(value.String(), "\""), nil
 }
 
-func Close() {
-	conn.Close()
+/* release the bus name and close the connection */
+func (s *Service) Close() {
+	if s.conn == nil {
+		return
+	}
+	if _, err := s.conn.ReleaseName(s.Identity.ServiceName); err != nil {
+		log.WithFields(log.Fields{"service": s.Identity.ServiceName, "error": err}).Warn("could not release dbus name")
+	}
+	s.conn.Close()
 }
 
 /* connect to DBUS */
-func Connect() {
+func (s *Service) Connect() {
+	id := s.Identity
 	// Need to implement following paths:
 	// https://github.com/victronenergy/venus/wiki/dbus#grid-meter
+	// plus whatever the role needs on top (see roles.go)
 	// also in system.py
-	victronValues[0]["/Connected"] = dbus.MakeVariant(1)
-	victronValues[1]["/Connected"] = dbus.MakeVariant("1")
+	s.victronValues[0]["/Connected"] = dbus.MakeVariant(1)
+	s.victronValues[1]["/Connected"] = dbus.MakeVariant("1")
 
-	victronValues[0]["/CustomName"] = dbus.MakeVariant("Grid meter")
-	victronValues[1]["/CustomName"] = dbus.MakeVariant("Grid meter")
+	s.victronValues[0]["/CustomName"] = dbus.MakeVariant(id.CustomName)
+	s.victronValues[1]["/CustomName"] = dbus.MakeVariant(id.CustomName)
 
-	victronValues[0]["/DeviceInstance"] = dbus.MakeVariant(30)
-	victronValues[1]["/DeviceInstance"] = dbus.MakeVariant("30")
+	s.victronValues[0]["/DeviceInstance"] = dbus.MakeVariant(id.DeviceInstance)
+	s.victronValues[1]["/DeviceInstance"] = dbus.MakeVariant(fmt.Sprintf("%d", id.DeviceInstance))
 
 	// also in system.py
-	victronValues[0]["/DeviceType"] = dbus.MakeVariant(71)
-	victronValues[1]["/DeviceType"] = dbus.MakeVariant("71")
+	s.victronValues[0]["/DeviceType"] = dbus.MakeVariant(id.DeviceType)
+	s.victronValues[1]["/DeviceType"] = dbus.MakeVariant(fmt.Sprintf("%d", id.DeviceType))
 
-	victronValues[0]["/ErrorCode"] = dbus.MakeVariantWithSignature(0, dbus.SignatureOf(123))
-	victronValues[1]["/ErrorCode"] = dbus.MakeVariant("0")
+	s.victronValues[0]["/ErrorCode"] = dbus.MakeVariantWithSignature(0, dbus.SignatureOf(123))
+	s.victronValues[1]["/ErrorCode"] = dbus.MakeVariant("0")
 
-	victronValues[0]["/FirmwareVersion"] = dbus.MakeVariant(2)
-	victronValues[1]["/FirmwareVersion"] = dbus.MakeVariant("2")
+	s.victronValues[0]["/FirmwareVersion"] = dbus.MakeVariant(2)
+	s.victronValues[1]["/FirmwareVersion"] = dbus.MakeVariant("2")
 
 	// also in system.py
-	victronValues[0]["/Mgmt/Connection"] = dbus.MakeVariant("/dev/ttyUSB0")
-	victronValues[1]["/Mgmt/Connection"] = dbus.MakeVariant("/dev/ttyUSB0")
+	s.victronValues[0]["/Mgmt/Connection"] = dbus.MakeVariant("/dev/ttyUSB0")
+	s.victronValues[1]["/Mgmt/Connection"] = dbus.MakeVariant("/dev/ttyUSB0")
 
-	victronValues[0]["/Mgmt/ProcessName"] = dbus.MakeVariant("/opt/color-control/dbus-cgwacs/dbus-cgwacs")
-	victronValues[1]["/Mgmt/ProcessName"] = dbus.MakeVariant("/opt/color-control/dbus-cgwacs/dbus-cgwacs")
+	s.victronValues[0]["/Mgmt/ProcessName"] = dbus.MakeVariant("/opt/color-control/dbus-cgwacs/dbus-cgwacs")
+	s.victronValues[1]["/Mgmt/ProcessName"] = dbus.MakeVariant("/opt/color-control/dbus-cgwacs/dbus-cgwacs")
 
-	victronValues[0]["/Mgmt/ProcessVersion"] = dbus.MakeVariant("1.8.0")
-	victronValues[1]["/Mgmt/ProcessVersion"] = dbus.MakeVariant("1.8.0")
+	s.victronValues[0]["/Mgmt/ProcessVersion"] = dbus.MakeVariant("1.8.0")
+	s.victronValues[1]["/Mgmt/ProcessVersion"] = dbus.MakeVariant("1.8.0")
 
-	victronValues[0]["/Position"] = dbus.MakeVariantWithSignature(0, dbus.SignatureOf(123))
-	victronValues[1]["/Position"] = dbus.MakeVariant("0")
+	s.victronValues[0]["/Position"] = dbus.MakeVariantWithSignature(id.Position, dbus.SignatureOf(123))
+	s.victronValues[1]["/Position"] = dbus.MakeVariant(fmt.Sprintf("%d", id.Position))
 
 	// also in system.py
-	victronValues[0]["/ProductId"] = dbus.MakeVariant(45058)
-	victronValues[1]["/ProductId"] = dbus.MakeVariant("45058")
+	s.victronValues[0]["/ProductId"] = dbus.MakeVariant(id.ProductId)
+	s.victronValues[1]["/ProductId"] = dbus.MakeVariant(fmt.Sprintf("%d", id.ProductId))
 
 	// also in system.py
-	victronValues[0]["/ProductName"] = dbus.MakeVariant("Grid meter")
-	victronValues[1]["/ProductName"] = dbus.MakeVariant("Grid meter")
+	s.victronValues[0]["/ProductName"] = dbus.MakeVariant(id.ProductName)
+	s.victronValues[1]["/ProductName"] = dbus.MakeVariant(id.ProductName)
 
-	victronValues[0]["/Serial"] = dbus.MakeVariant("BP98305081235")
-	victronValues[1]["/Serial"] = dbus.MakeVariant("BP98305081235")
+	s.victronValues[0]["/Serial"] = dbus.MakeVariant(id.Serial)
+	s.victronValues[1]["/Serial"] = dbus.MakeVariant(id.Serial)
 
 	// Provide some initial values... note that the values must be a valid formt otherwise dbus_systemcalc.py exits like this:
 	//@400000005ecc11bf3782b374   File "/opt/victronenergy/dbus-systemcalc-py/dbus_systemcalc.py", line 386, in _handletimertick
@@ -127,40 +163,8 @@ func Connect() {
 	//@400000005ecc11bf387b28ec     return sum(values) if values else None
 	//@400000005ecc11bf38b2bb7c TypeError: unsupported operand type(s) for +: 'int' and 'unicode'
 	//
-	victronValues[0]["/Ac/L1/Power"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Power"] = dbus.MakeVariant("0 W")
-	victronValues[0]["/Ac/L2/Power"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Power"] = dbus.MakeVariant("0 W")
-	victronValues[0]["/Ac/L3/Power"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Power"] = dbus.MakeVariant("0 W")
-
-	victronValues[0]["/Ac/L1/Voltage"] = dbus.MakeVariant(230)
-	victronValues[1]["/Ac/L1/Voltage"] = dbus.MakeVariant("230 V")
-	victronValues[0]["/Ac/L2/Voltage"] = dbus.MakeVariant(230)
-	victronValues[1]["/Ac/L2/Voltage"] = dbus.MakeVariant("230 V")
-	victronValues[0]["/Ac/L3/Voltage"] = dbus.MakeVariant(230)
-	victronValues[1]["/Ac/L3/Voltage"] = dbus.MakeVariant("230 V")
-
-	victronValues[0]["/Ac/L1/Current"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Current"] = dbus.MakeVariant("0 A")
-	victronValues[0]["/Ac/L2/Current"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Current"] = dbus.MakeVariant("0 A")
-	victronValues[0]["/Ac/L3/Current"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Current"] = dbus.MakeVariant("0 A")
-
-	victronValues[0]["/Ac/L1/Energy/Forward"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Energy/Forward"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L2/Energy/Forward"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Energy/Forward"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L3/Energy/Forward"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Energy/Forward"] = dbus.MakeVariant("0 kWh")
-
-	victronValues[0]["/Ac/L1/Energy/Reverse"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L1/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L2/Energy/Reverse"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L2/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
-	victronValues[0]["/Ac/L3/Energy/Reverse"] = dbus.MakeVariant(0.0)
-	victronValues[1]["/Ac/L3/Energy/Reverse"] = dbus.MakeVariant("0 kWh")
+	// see updatingPaths() in paths.go
+	updatingPaths := s.updatingPaths()
 
 	basicPaths := []dbus.ObjectPath{
 		"/Connected",
@@ -177,29 +181,20 @@ func Connect() {
 		"/ProductName",
 		"/Serial",
 	}
+	basicPaths = append(basicPaths, s.rolePaths()...)
 
-	updatingPaths := []dbus.ObjectPath{
-		"/Ac/L1/Power",
-		"/Ac/L2/Power",
-		"/Ac/L3/Power",
-		"/Ac/L1/Voltage",
-		"/Ac/L2/Voltage",
-		"/Ac/L3/Voltage",
-		"/Ac/L1/Current",
-		"/Ac/L2/Current",
-		"/Ac/L3/Current",
-		"/Ac/L1/Energy/Forward",
-		"/Ac/L2/Energy/Forward",
-		"/Ac/L3/Energy/Forward",
-		"/Ac/L1/Energy/Reverse",
-		"/Ac/L2/Energy/Reverse",
-		"/Ac/L3/Energy/Reverse",
-	}
-
-	// Some of the victron stuff requires it be called grid.cgwacs... using the only known valid value (from the simulator)
-	// This can _probably_ be changed as long as it matches com.victronenergy.grid.cgwacs_*
+	// Some of the victron stuff requires it be called grid.cgwacs... the default is the only known valid value (from the simulator)
+	// This can _probably_ be changed as long as it matches com.victronenergy.<role>.*
 	if !DryRun {
-		reply, err := conn.RequestName("com.victronenergy.grid.cgwacs_ttyUSB0_di30_mb1",
+		var err error
+		// every service needs its own connection, exported objects are per connection
+		s.conn, err = dbus.ConnectSystemBus()
+		if err != nil {
+			log.Panic("Something went horribly wrong in the dbus connection")
+			panic(err)
+		}
+
+		reply, err := s.conn.RequestName(id.ServiceName,
 			dbus.NameFlagDoNotQueue)
 		if err != nil {
 			log.Panic("Something went horribly wrong in the dbus connection")
@@ -207,69 +202,55 @@ func Connect() {
 		}
 
 		if reply != dbus.RequestNameReplyPrimaryOwner {
-			log.Panic("name cgwacs_ttyUSB0_di30_mb1 already taken on dbus.")
+			log.Panic("name " + id.ServiceName + " already taken on dbus.")
 			os.Exit(1)
 		}
 	}
 
-	for i, s := range basicPaths {
-		log.Trace("Registering dbus basic path #", i, ": ", s)
+	for i, p := range basicPaths {
+		log.Trace("Registering dbus basic path #", i, ": ", p)
 		if !DryRun {
-			conn.Export(objectpath(s), s, "com.victronenergy.BusItem")
-			conn.Export(introspect.Introspectable(intro), s, "org.freedesktop.DBus.Introspectable")
+			s.conn.Export(busItem{service: s, path: objectpath(p)}, p, "com.victronenergy.BusItem")
+			s.conn.Export(introspect.Introspectable(intro), p, "org.freedesktop.DBus.Introspectable")
 		}
 	}
 
-	for i, s := range updatingPaths {
-		log.Trace("Registering dbus update path #", i, ": ", s)
+	for i, p := range updatingPaths {
+		log.Trace("Registering dbus update path #", i, ": ", p)
 		if !DryRun {
-			conn.Export(objectpath(s), s, "com.victronenergy.BusItem")
-			conn.Export(introspect.Introspectable(intro), s, "org.freedesktop.DBus.Introspectable")
+			s.conn.Export(busItem{service: s, path: objectpath(p)}, p, "com.victronenergy.BusItem")
+			s.conn.Export(introspect.Introspectable(intro), p, "org.freedesktop.DBus.Introspectable")
 		}
 	}
 
-}
-
-/* Write dbus Values to Victron handler */
-func Update(value float64, unit string, path string) (err error) {
-	emit := make(map[string]dbus.Variant)
-	emit["Text"] = dbus.MakeVariant(fmt.Sprintf("%.2f", value) + unit)
-	emit["Value"] = dbus.MakeVariant(float64(value))
-	victronValuesMutex.Lock()
-	victronValues[0][objectpath(path)] = emit["Value"]
-	victronValues[1][objectpath(path)] = emit["Text"]
-	victronValuesMutex.Unlock()
+	log.Trace("Registering dbus root path")
 	if !DryRun {
-		err = conn.Emit(dbus.ObjectPath(path), "com.victronenergy.BusItem.PropertiesChanged", emit)
+		s.conn.Export(rootItem{service: s}, "/", "com.victronenergy.BusItem")
+		s.conn.Export(introspect.Introspectable(introRoot), "/", "org.freedesktop.DBus.Introspectable")
 	}
-	if err != nil {
-		log.WithFields(log.Fields{"path": path, "unit": unit, "value": value}).Warn("could not update dbus value")
-	} else {
-		log.WithFields(log.Fields{"path": path, "unit": unit, "value": value}).Trace("new dbus value")
 
-	}
-	return
 }
 
-/* Write dbus Values to Victron handler */
-func Queue(value float64, unit string, path string) (err error) {
-	dbmsg := dbusMsg{
-		Value: value,
-		Unit:  unit,
-		Path:  path,
+/* Flip /Connected, f.e. while there is no data from MQTT */
+func (s *Service) SetConnected(state bool) {
+	value := 0
+	if state {
+		value = 1
 	}
-	dbusChan <- dbmsg
-	return
-}
+	s.valuesMutex.Lock()
+	s.connected = state
+	s.valuesMutex.Unlock()
 
-func Worker(ctx context.Context) {
-	for {
-		v, ok := <-dbusChan
-		if ok == false {
-			break
-		}
-		Update(v.Value, v.Unit, v.Path)
-		// spew.Dump(v)
+	err := s.emit("/Connected", dbus.MakeVariant(value), fmt.Sprintf("%d", value))
+	if err != nil {
+		log.WithFields(log.Fields{"service": s.Identity.ServiceName, "connected": value}).Warn("could not update dbus connection state")
+	} else {
+		log.WithFields(log.Fields{"service": s.Identity.ServiceName, "connected": value}).Debug("dbus connection state changed")
 	}
+}
 
+func (s *Service) IsConnected() bool {
+	s.valuesMutex.RLock()
+	defer s.valuesMutex.RUnlock()
+	return s.connected
 }
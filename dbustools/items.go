@@ -0,0 +1,157 @@
+package dbustools
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/introspect"
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const introRoot = `
+<node>
+   <interface name="com.victronenergy.BusItem">
+    <signal name="ItemsChanged">
+      <arg type="a{sa{sv}}" name="changes" />
+    </signal>
+    <method name="GetItems">
+      <arg direction="out" type="a{sa{sv}}" />
+    </method>
+    </interface>` + introspect.IntrospectDataString + `</node> `
+
+// paths that may be changed over the dbus (f.e. from the GUI) and the config key they are persisted as
+var writablePaths = map[objectpath]string{
+	"/CustomName": "customname",
+	"/Position":   "position",
+}
+
+// SetValueHandler is called before a writable path is changed, returning an error rejects the change
+type SetValueHandler func(key string, value interface{}) error
+
+// rootItem is the com.victronenergy.BusItem exported on "/", used by newer Venus OS versions for bulk reads
+type rootItem struct {
+	service *Service
+}
+
+func (f busItem) SetValue(value dbus.Variant) (int32, *dbus.Error) {
+	s := f.service
+	logger := log.WithFields(log.Fields{"service": s.Identity.ServiceName, "path": f.path, "value": value})
+
+	key, ok := writablePaths[f.path]
+	if !ok {
+		logger.Warn("SetValue() called for read only path")
+		return 1, nil
+	}
+
+	var v interface{}
+	var text string
+	switch key {
+	case "customname":
+		name, ok := value.Value().(string)
+		if !ok {
+			logger.Warn("SetValue() expects a string")
+			return 1, nil
+		}
+		v, text = name, name
+	case "position":
+		pos, ok := toInt(value.Value())
+		if !ok || pos < 0 || pos > 2 {
+			logger.Warn("SetValue() expects a position of 0, 1 or 2")
+			return 1, nil
+		}
+		v, text = pos, fmt.Sprintf("%d", pos)
+	}
+
+	if s.OnSetValue != nil {
+		if err := s.OnSetValue(key, v); err != nil {
+			logger.WithField("error", err).Warn("could not persist value")
+			return 1, nil
+		}
+	}
+	s.valuesMutex.Lock()
+	s.Identity.Set(key, v)
+	s.valuesMutex.Unlock()
+
+	variant := dbus.MakeVariant(v)
+	if key == "position" {
+		variant = dbus.MakeVariantWithSignature(v, dbus.SignatureOf(123))
+	}
+	if err := s.emit(string(f.path), variant, text); err != nil {
+		logger.Warn("could not update dbus value")
+	}
+	logger.Info("value changed over dbus")
+	return 0, nil
+}
+
+func (f rootItem) GetItems() (map[string]map[string]dbus.Variant, *dbus.Error) {
+	log.Debug("GetItems() called")
+	s := f.service
+	s.valuesMutex.RLock()
+	defer s.valuesMutex.RUnlock()
+
+	items := make(map[string]map[string]dbus.Variant, len(s.victronValues[0]))
+	for path, value := range s.victronValues[0] {
+		items[string(path)] = map[string]dbus.Variant{
+			"Value": value,
+			"Text":  dbus.MakeVariant(strings.Trim(s.victronValues[1][path].String(), "\"")),
+		}
+	}
+	return items, nil
+}
+
+/* value of a path, as GetValue over the dbus returns it */
+func (s *Service) Value(path string) dbus.Variant {
+	value, _ := busItem{service: s, path: objectpath(path)}.GetValue()
+	return value
+}
+
+/* all values, as GetItems on the root returns them */
+func (s *Service) Items() map[string]map[string]dbus.Variant {
+	items, _ := rootItem{service: s}.GetItems()
+	return items
+}
+
+/* store a value and let everyone know, per path with PropertiesChanged and on the root with ItemsChanged */
+func (s *Service) emit(path string, value dbus.Variant, text string) (err error) {
+	emit := make(map[string]dbus.Variant)
+	emit["Text"] = dbus.MakeVariant(text)
+	emit["Value"] = value
+	s.valuesMutex.Lock()
+	s.victronValues[0][objectpath(path)] = emit["Value"]
+	s.victronValues[1][objectpath(path)] = emit["Text"]
+	s.valuesMutex.Unlock()
+
+	if DryRun || s.conn == nil {
+		return
+	}
+	err = s.conn.Emit(dbus.ObjectPath(path), "com.victronenergy.BusItem.PropertiesChanged", emit)
+	if err != nil {
+		return
+	}
+	return s.conn.Emit("/", "com.victronenergy.BusItem.ItemsChanged", map[string]map[string]dbus.Variant{path: emit})
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch val := v.(type) {
+	case int:
+		return val, true
+	case int16:
+		return int(val), true
+	case int32:
+		return int(val), true
+	case int64:
+		return int(val), true
+	case uint16:
+		return int(val), true
+	case uint32:
+		return int(val), true
+	case uint64:
+		return int(val), true
+	case byte:
+		return int(val), true
+	case float64:
+		return int(val), val == float64(int(val))
+	}
+	return 0, false
+}
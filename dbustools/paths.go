@@ -0,0 +1,170 @@
+package dbustools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"victron_energymeter_mqtt/phase"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// phase names known to the Victron schema
+var PhaseNames = []string{"L1", "L2", "L3"}
+
+// PathFormat is how a value is shown as text on the dbus, f.e. "231.4 V"
+type PathFormat struct {
+	Unit      string
+	Precision int
+}
+
+// formats of the values, by their path below /Ac or /Ac/<phase>
+var pathFormats = map[string]PathFormat{
+	"Power":          {"W", 0},
+	"Voltage":        {"V", 1},
+	"Current":        {"A", 2},
+	"Energy/Forward": {"kWh", 2},
+	"Energy/Reverse": {"kWh", 2},
+	"Frequency":      {"Hz", 2},
+	"PowerFactor":    {"", 2},
+	"ReactivePower":  {"var", 0},
+	"MaxPower":       {"W", 0},
+}
+
+var defaultFormat = PathFormat{"", 2}
+
+/*
+dbus path of each phase.SinglePhase field, below /Ac/<phase>
+
+Direction model, seen from the meter at the grid connection:
+  - Imported: energy bought, flowing grid -> house, Victron calls this Energy/Forward
+  - Exported: energy sold, flowing house -> grid, Victron calls this Energy/Reverse
+  - Power (and Current) are positive while importing and negative while exporting
+
+For a Shelly 3EM "total" is Imported and "total_returned" is Exported.
+Meters using the opposite convention can be flipped with "invert" on the meter
+*/
+var fieldPaths = map[string]string{
+	"Power":         "Power",
+	"Voltage":       "Voltage",
+	"Current":       "Current",
+	"Imported":      "Energy/Forward",
+	"Exported":      "Energy/Reverse",
+	"PowerFactor":   "PowerFactor",
+	"ReactivePower": "ReactivePower",
+}
+
+/* dbus path of a phase field, f.e. ("L1", "Voltage") -> /Ac/L1/Voltage */
+func PhasePath(phase string, field string) string {
+	return "/Ac/" + phase + "/" + fieldPaths[field]
+}
+
+/* format of a value path like /Ac/L1/Voltage or /Ac/Power */
+func FormatFor(path string) PathFormat {
+	rel := strings.TrimPrefix(path, "/Ac/")
+	for _, name := range PhaseNames {
+		rel = strings.TrimPrefix(rel, name+"/")
+	}
+	if format, ok := pathFormats[rel]; ok {
+		return format
+	}
+	return defaultFormat
+}
+
+func (f PathFormat) Text(value float64) string {
+	if f.Unit == "" {
+		return strconv.FormatFloat(value, 'f', f.Precision, 64)
+	}
+	return strconv.FormatFloat(value, 'f', f.Precision, 64) + " " + f.Unit
+}
+
+type pathValue struct {
+	Path  string
+	Value float64
+}
+
+// paths for the totals of the meter, always exported
+var totalPaths = []pathValue{
+	{"/Ac/Power", 0},
+	{"/Ac/Energy/Forward", 0},
+	{"/Ac/Energy/Reverse", 0},
+}
+
+/* paths of a single phase with their initial value, optional values only if they are mapped */
+func phasePaths(ph phase.SinglePhase) []pathValue {
+	name := ph.Name
+	paths := []pathValue{
+		{PhasePath(name, "Power"), 0},
+		{PhasePath(name, "Voltage"), 230},
+		{PhasePath(name, "Current"), 0},
+		{PhasePath(name, "Exported"), 0},
+		{PhasePath(name, "Imported"), 0},
+	}
+	if ph.Provides("PowerFactor") || ph.Derives("PowerFactor") {
+		paths = append(paths, pathValue{PhasePath(name, "PowerFactor"), 1})
+	}
+	if ph.Provides("ReactivePower") {
+		paths = append(paths, pathValue{PhasePath(name, "ReactivePower"), 0})
+	}
+	return paths
+}
+
+/* frequency is only exported once for the whole meter, if any phase provides it */
+func HasFrequency(lines []phase.SinglePhase) bool {
+	for _, ph := range lines {
+		if ph.Provides("Frequency") {
+			return true
+		}
+	}
+	return false
+}
+
+/* make sure all phases are known to the Victron schema and not used twice */
+func ValidatePhases(phases []string) error {
+	seen := make(map[string]bool)
+	for _, name := range phases {
+		known := false
+		for _, valid := range PhaseNames {
+			known = known || name == valid
+		}
+		if !known {
+			return fmt.Errorf("phase name %q is unknown, use one of %v", name, PhaseNames)
+		}
+		if seen[name] {
+			return fmt.Errorf("phase %s is configured twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+/* the updating paths with their initial values, derived from the configured phases */
+func pathValues(lines []phase.SinglePhase) []pathValue {
+	all := append([]pathValue{}, totalPaths...)
+	if HasFrequency(lines) {
+		all = append(all, pathValue{"/Ac/Frequency", 50})
+	}
+	for _, ph := range lines {
+		all = append(all, phasePaths(ph)...)
+	}
+	return all
+}
+
+/* paths a meter with these phases exports, they are registered once when the service starts */
+func Paths(lines []phase.SinglePhase) (paths []string) {
+	for _, p := range pathValues(lines) {
+		paths = append(paths, p.Path)
+	}
+	return
+}
+
+/* initial values of the updating paths, derived from the configured phases */
+func (s *Service) updatingPaths() (paths []dbus.ObjectPath) {
+	for _, p := range pathValues(s.Phases) {
+		s.victronValues[0][objectpath(p.Path)] = dbus.MakeVariant(p.Value)
+		s.victronValues[1][objectpath(p.Path)] = dbus.MakeVariant(FormatFor(p.Path).Text(p.Value))
+		paths = append(paths, dbus.ObjectPath(p.Path))
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package dbustools
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueueStats are the counters of the update queue since the start
+type QueueStats struct {
+	Queued    uint64 // values passed to Queue
+	Coalesced uint64 // values replaced by a newer one for the same path before they were emitted
+	Dropped   uint64 // values queued after the worker stopped
+	Emitted   uint64 // values written to the dbus
+	Batches   uint64 // number of emitted batches
+}
+
+// updateQueue keeps only the latest value per path, so Queue never blocks the MQTT handler
+type updateQueue struct {
+	mutex   sync.Mutex
+	pending map[string]dbusMsg
+	order   []string // paths in the order they were first queued
+
+	wake    chan struct{} // signals the worker that there is something to emit
+	stopped chan struct{} // closed once the worker stopped
+
+	stats QueueStats
+}
+
+func newUpdateQueue() *updateQueue {
+	return &updateQueue{
+		pending: make(map[string]dbusMsg),
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+}
+
+/* Queue a value for the Victron handler, never blocks */
+func (s *Service) Queue(value float64, path string) (err error) {
+	q := s.queue
+	atomic.AddUint64(&q.stats.Queued, 1)
+
+	select {
+	case <-q.stopped:
+		atomic.AddUint64(&q.stats.Dropped, 1)
+		return fmt.Errorf("dbus worker stopped, dropping %s", path)
+	default:
+	}
+
+	q.mutex.Lock()
+	if _, ok := q.pending[path]; ok {
+		atomic.AddUint64(&q.stats.Coalesced, 1)
+	} else {
+		q.order = append(q.order, path)
+	}
+	q.pending[path] = dbusMsg{
+		Value: value,
+		Path:  path,
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// worker is already woken up
+	}
+	return
+}
+
+/* Emit queued values in batches until ctx is cancelled, then flush what is still pending */
+func (s *Service) Worker(ctx context.Context) {
+	defer close(s.queue.stopped)
+	for {
+		select {
+		case <-s.queue.wake:
+			s.flush()
+		case <-ctx.Done():
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *Service) Stats() QueueStats {
+	q := s.queue
+	return QueueStats{
+		Queued:    atomic.LoadUint64(&q.stats.Queued),
+		Coalesced: atomic.LoadUint64(&q.stats.Coalesced),
+		Dropped:   atomic.LoadUint64(&q.stats.Dropped),
+		Emitted:   atomic.LoadUint64(&q.stats.Emitted),
+		Batches:   atomic.LoadUint64(&q.stats.Batches),
+	}
+}
+
+/* take everything pending and emit it as one batch */
+func (s *Service) flush() {
+	q := s.queue
+	q.mutex.Lock()
+	pending, order := q.pending, q.order
+	q.pending = make(map[string]dbusMsg, len(pending))
+	q.order = nil
+	q.mutex.Unlock()
+
+	if len(order) == 0 {
+		return
+	}
+
+	batch := make([]dbusMsg, 0, len(order))
+	for _, path := range order {
+		batch = append(batch, pending[path])
+	}
+	if err := s.emitBatch(batch); err != nil {
+		log.WithFields(log.Fields{"service": s.Identity.ServiceName, "count": len(batch), "error": err}).Warn("could not update dbus values")
+	}
+	atomic.AddUint64(&q.stats.Emitted, uint64(len(batch)))
+	atomic.AddUint64(&q.stats.Batches, 1)
+}
+
+/* like emit, but for many values with a single ItemsChanged on the root */
+func (s *Service) emitBatch(batch []dbusMsg) (err error) {
+	changes := make(map[string]map[string]dbus.Variant, len(batch))
+	s.valuesMutex.Lock()
+	for _, v := range batch {
+		emit := map[string]dbus.Variant{
+			"Value": dbus.MakeVariant(v.Value),
+			"Text":  dbus.MakeVariant(FormatFor(v.Path).Text(v.Value)),
+		}
+		s.victronValues[0][objectpath(v.Path)] = emit["Value"]
+		s.victronValues[1][objectpath(v.Path)] = emit["Text"]
+		changes[v.Path] = emit
+		log.WithFields(log.Fields{"service": s.Identity.ServiceName, "path": v.Path, "value": v.Value}).Trace("new dbus value")
+	}
+	s.valuesMutex.Unlock()
+
+	if DryRun || s.conn == nil {
+		return
+	}
+	for path, emit := range changes {
+		if e := s.conn.Emit(dbus.ObjectPath(path), "com.victronenergy.BusItem.PropertiesChanged", emit); e != nil {
+			err = e
+		}
+	}
+	if e := s.conn.Emit("/", "com.victronenergy.BusItem.ItemsChanged", changes); e != nil {
+		err = e
+	}
+	return
+}
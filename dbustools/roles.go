@@ -0,0 +1,117 @@
+package dbustools
+
+import (
+	"fmt"
+	"regexp"
+
+	vc "victron_energymeter_mqtt/config"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Role describes how the meter presents itself on the dbus
+// see https://github.com/victronenergy/venus/wiki/dbus
+type Role struct {
+	DeviceType  int
+	ProductId   int
+	ProductName string
+
+	// additional paths this role requires, with their initial value
+	Paths map[string]interface{}
+}
+
+var Roles = map[string]Role{
+	"grid": {
+		DeviceType:  71,
+		ProductId:   45058,
+		ProductName: "Grid meter",
+	},
+	"pvinverter": {
+		DeviceType:  71,
+		ProductId:   45058,
+		ProductName: "PV inverter",
+		Paths: map[string]interface{}{
+			"/StatusCode":  7, // running
+			"/Ac/MaxPower": 0.0,
+		},
+	},
+	"acload": {
+		DeviceType:  71,
+		ProductId:   45058,
+		ProductName: "AC load",
+	},
+	"genset": {
+		DeviceType:  71,
+		ProductId:   45058,
+		ProductName: "Generator",
+		Paths: map[string]interface{}{
+			"/StatusCode": 8, // running
+		},
+	},
+	"evcharger": {
+		DeviceType:  0,
+		ProductId:   49188, // 0xC024, EV charging station
+		ProductName: "EV charger",
+		Paths: map[string]interface{}{
+			"/Status": 0, // disconnected
+			"/Mode":   0, // manual
+		},
+	},
+}
+
+var serviceNameRegex = regexp.MustCompile(`^com\.victronenergy\.([a-z]+)\.[A-Za-z_][A-Za-z0-9_-]*(\.[A-Za-z_][A-Za-z0-9_-]*)*$`)
+
+/* Fill in the role defaults for everything not set in the config and validate the result */
+func ResolveIdentity(id vc.DbusConfig) (vc.DbusConfig, error) {
+	role, ok := Roles[id.Role]
+	if !ok {
+		return id, fmt.Errorf("unknown dbus role %q", id.Role)
+	}
+
+	if id.ServiceName == "" {
+		if id.Role == "grid" {
+			// the only known valid value for a grid meter (from the simulator)
+			id.ServiceName = fmt.Sprintf("com.victronenergy.grid.cgwacs_ttyUSB0_di%d_mb1", id.DeviceInstance)
+		} else {
+			id.ServiceName = fmt.Sprintf("com.victronenergy.%s.mqtt_di%d", id.Role, id.DeviceInstance)
+		}
+	}
+	if id.DeviceType == 0 {
+		id.DeviceType = role.DeviceType
+	}
+	if id.ProductId == 0 {
+		id.ProductId = role.ProductId
+	}
+	if id.ProductName == "" {
+		id.ProductName = role.ProductName
+	}
+	if id.CustomName == "" {
+		id.CustomName = id.ProductName
+	}
+
+	match := serviceNameRegex.FindStringSubmatch(id.ServiceName)
+	if match == nil || match[1] != id.Role {
+		return id, fmt.Errorf("dbus servicename %q does not match com.victronenergy.%s.*", id.ServiceName, id.Role)
+	}
+	if id.Position < 0 || id.Position > 2 {
+		return id, fmt.Errorf("dbus position %d must be 0 (AC input 1), 1 (AC output) or 2 (AC input 2)", id.Position)
+	}
+	return id, nil
+}
+
+/* initial values of the paths required by the role */
+func (s *Service) rolePaths() (paths []dbus.ObjectPath) {
+	for path, value := range Roles[s.Identity.Role].Paths {
+		if path == "/Ac/MaxPower" {
+			value = s.Identity.MaxPower
+		}
+		s.victronValues[0][objectpath(path)] = dbus.MakeVariant(value)
+		if v, ok := value.(float64); ok {
+			s.victronValues[1][objectpath(path)] = dbus.MakeVariant(FormatFor(path).Text(v))
+		} else {
+			s.victronValues[1][objectpath(path)] = dbus.MakeVariant(fmt.Sprintf("%v", value))
+		}
+		paths = append(paths, dbus.ObjectPath(path))
+	}
+	return
+}
@@ -0,0 +1,309 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed arithmetic expression like "grid_total - pv_l1" or "abs(Power)/Voltage".
+// It knows numbers, names, + - * /, parentheses and the functions in funcs.
+type Expr struct {
+	source string
+	root   node
+}
+
+// Lookup resolves a name to its current value, false if the value is not known (yet)
+type Lookup func(name string) (float64, bool)
+
+type node interface {
+	eval(lookup Lookup) (float64, error)
+}
+
+type number float64
+
+type name string
+
+type unary struct {
+	x node
+}
+
+type binary struct {
+	op   byte
+	x, y node
+}
+
+type call struct {
+	fn   string
+	args []node
+}
+
+var funcs = map[string]struct {
+	min, max int // number of arguments, max -1 for any
+	fn       func(args []float64) float64
+}{
+	"abs":  {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt": {1, 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"min": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	"max": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+}
+
+/* parse an expression, the error points to the position of the problem */
+func Parse(source string) (*Expr, error) {
+	p := &parser{src: source}
+	p.next()
+	root, err := p.expr()
+	if err == nil && p.tok != "" {
+		err = p.errorf("unexpected %q", p.tok)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", source, err)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+/* evaluate the expression, fails if a name is unknown or the result is not a finite number */
+func (e *Expr) Eval(lookup Lookup) (float64, error) {
+	v, err := e.root.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("expression %q is not a number", e.source)
+	}
+	return v, nil
+}
+
+/* all names used in the expression */
+func (e *Expr) Names() (names []string) {
+	var walk func(n node)
+	walk = func(n node) {
+		switch n := n.(type) {
+		case name:
+			names = append(names, string(n))
+		case unary:
+			walk(n.x)
+		case binary:
+			walk(n.x)
+			walk(n.y)
+		case call:
+			for _, a := range n.args {
+				walk(a)
+			}
+		}
+	}
+	walk(e.root)
+	return
+}
+
+func (n number) eval(Lookup) (float64, error) {
+	return float64(n), nil
+}
+
+func (n name) eval(lookup Lookup) (float64, error) {
+	v, ok := lookup(string(n))
+	if !ok {
+		return 0, fmt.Errorf("no value for %s", string(n))
+	}
+	return v, nil
+}
+
+func (n unary) eval(lookup Lookup) (float64, error) {
+	v, err := n.x.eval(lookup)
+	return -v, err
+}
+
+func (n binary) eval(lookup Lookup) (float64, error) {
+	x, err := n.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	y, err := n.y.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	default:
+		return x / y, nil
+	}
+}
+
+func (n call) eval(lookup Lookup) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(lookup)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return funcs[n.fn].fn(args), nil
+}
+
+type parser struct {
+	src string
+	pos int // position after tok
+	tok string
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return errorAt(p.pos-len(p.tok), format, args...)
+}
+
+func errorAt(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", pos, fmt.Sprintf(format, args...))
+}
+
+/* read the next token: a number, a name, a single character operator or "" at the end */
+func (p *parser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	c := rune(p.src[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+	case unicode.IsLetter(c) || c == '_':
+		for p.pos < len(p.src) && isNameChar(rune(p.src[p.pos])) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func isNameChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+// expr := term { ("+" | "-") term }
+func (p *parser) expr() (node, error) {
+	x, err := p.term()
+	for err == nil && (p.tok == "+" || p.tok == "-") {
+		op := p.tok[0]
+		p.next()
+		var y node
+		y, err = p.term()
+		x = binary{op, x, y}
+	}
+	return x, err
+}
+
+// term := unary { ("*" | "/") unary }
+func (p *parser) term() (node, error) {
+	x, err := p.unary()
+	for err == nil && (p.tok == "*" || p.tok == "/") {
+		op := p.tok[0]
+		p.next()
+		var y node
+		y, err = p.unary()
+		x = binary{op, x, y}
+	}
+	return x, err
+}
+
+// unary := "-" unary | primary
+func (p *parser) unary() (node, error) {
+	if p.tok == "-" {
+		p.next()
+		x, err := p.unary()
+		return unary{x}, err
+	}
+	return p.primary()
+}
+
+// primary := number | name | func "(" expr { "," expr } ")" | "(" expr ")"
+func (p *parser) primary() (node, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, p.errorf("unexpected end")
+	case tok == "(":
+		p.next()
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, p.errorf("missing )")
+		}
+		p.next()
+		return x, nil
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", tok)
+		}
+		p.next()
+		return number(v), nil
+	case unicode.IsLetter(rune(tok[0])) || tok[0] == '_':
+		start := p.pos - len(tok)
+		p.next()
+		if p.tok != "(" {
+			return name(tok), nil
+		}
+		return p.call(strings.ToLower(tok), start)
+	}
+	return nil, p.errorf("unexpected %q", tok)
+}
+
+/* arguments of the function fn, its name starts at start, errors about the function point there */
+func (p *parser) call(fn string, start int) (node, error) {
+	f, ok := funcs[fn]
+	if !ok {
+		return nil, errorAt(start, "unknown function %s", fn)
+	}
+	p.next() // (
+	var args []node
+	for {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, x)
+		if p.tok != "," {
+			break
+		}
+		p.next()
+	}
+	if p.tok != ")" {
+		return nil, p.errorf("missing ) after arguments of %s", fn)
+	}
+	p.next()
+	if len(args) < f.min || (f.max >= 0 && len(args) > f.max) {
+		return nil, errorAt(start, "wrong number of arguments for %s", fn)
+	}
+	return call{fn, args}, nil
+}
@@ -0,0 +1,102 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	values := map[string]float64{"a": 2, "b": 3, "L1.Power": 100, "grid_total": 10}
+	lookup := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	tests := []struct {
+		source string
+		want   float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"8 / 4 / 2", 1},
+		{"8 - 4 - 2", 2},
+		{"-a * b", -6},
+		{"- -a", 2},
+		{"a - -b", 5},
+		{"-(a + b)", -5},
+		{"2 * -a", -4},
+		{"L1.Power / 4", 25},
+		{"grid_total - a", 8},
+		{".5 * a", 1},
+		{"abs(-a)", 2},
+		{"ABS(a - b)", 1},
+		{"sqrt(a * 8)", 4},
+		{"min(a, b, 1)", 1},
+		{"max(a)", 2},
+		{"max(a, b) * 2", 6},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.source)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.source, err)
+			continue
+		}
+		if got, err := e.Eval(lookup); err != nil || got != test.want {
+			t.Errorf("Eval(%q) = %v, %v, want %v", test.source, got, err, test.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	lookup := func(name string) (float64, bool) { return 0, name == "zero" }
+	for _, source := range []string{"missing + 1", "1 / zero", "sqrt(-1)"} {
+		e, err := Parse(source)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", source, err)
+			continue
+		}
+		if got, err := e.Eval(lookup); err == nil {
+			t.Errorf("Eval(%q) = %v, want an error", source, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "at 0: unexpected end"},
+		{"1 +", "at 3: unexpected end"},
+		{"1 + * 2", `at 4: unexpected "*"`},
+		{"(1 + 2", "at 6: missing )"},
+		{"1 2", `at 2: unexpected "2"`},
+		{"1..2", `at 0: invalid number "1..2"`},
+		{"a # b", `at 2: unexpected "#"`},
+		{"foo(1)", "at 0: unknown function foo"},
+		{"1 + abs()", `at 8: unexpected ")"`},
+		{"abs(1, 2)", "at 0: wrong number of arguments for abs"},
+		{"2 * sqrt(1, 2)", "at 4: wrong number of arguments for sqrt"},
+		{"min(1, 2", "at 8: missing ) after arguments of min"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.source)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want %q", test.source, test.want)
+			continue
+		}
+		if !strings.HasSuffix(err.Error(), test.want) {
+			t.Errorf("Parse(%q) = %q, want %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	e, err := Parse("max(a, L1.Power) - -b * a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.Names(), []string{"a", "L1.Power", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/* Decode a raw JSON payload so it can be queried with Lookup */
+func Decode(payload []byte) (doc interface{}, err error) {
+	err = json.Unmarshal(payload, &doc)
+	return
+}
+
+/*
+Lookup resolves a simple JSON path inside a decoded document.
+Supported are dotted keys, array indices and quoted keys, with or without the leading "$":
+
+	emeters[0].power
+	$.ENERGY.Voltage
+	$['StatusSNS']['ENERGY']['Power']
+*/
+func Lookup(doc interface{}, path string) (interface{}, error) {
+	tokens, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := doc
+	for _, tok := range tokens {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[tok]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found in %q", tok, path)
+			}
+			cur = v
+		case []interface{}:
+			idx, err := strconv.Atoi(tok)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an array index in %q", tok, path)
+			}
+			if idx < 0 || idx >= len(node) {
+				return nil, fmt.Errorf("index %d out of range in %q", idx, path)
+			}
+			cur = node[idx]
+		default:
+			return nil, fmt.Errorf("cannot descend into %q in %q", tok, path)
+		}
+	}
+	return cur, nil
+}
+
+/* Lookup a value and convert it to float64 */
+func Float(doc interface{}, path string) (float64, error) {
+	v, err := Lookup(doc, path)
+	if err != nil {
+		return 0, err
+	}
+	return ToFloat(v)
+}
+
+/* Convert a decoded JSON value (number, numeric string or bool) to float64 */
+func ToFloat(v interface{}) (float64, error) {
+	switch val := v.(type) {
+	case float64:
+		return val, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			return 0, err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("value %q is not a finite number", val)
+		}
+		return f, nil
+	case bool:
+		if val {
+			return 1, nil
+		}
+		return 0, nil
+	case nil:
+		return 0, fmt.Errorf("value is null")
+	}
+	return 0, fmt.Errorf("value of type %T is not a number", v)
+}
+
+/* split a path into its keys and indices */
+func parse(path string) (tokens []string, err error) {
+	p := strings.TrimSpace(path)
+	p = strings.TrimPrefix(p, "$")
+	p = strings.TrimPrefix(p, ".")
+
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in %q", path)
+			}
+			tok := strings.TrimSpace(p[1:end])
+			if len(tok) >= 2 && (tok[0] == '\'' || tok[0] == '"') && tok[len(tok)-1] == tok[0] {
+				tok = tok[1 : len(tok)-1]
+			}
+			if tok == "" {
+				return nil, fmt.Errorf("empty index in %q", path)
+			}
+			tokens = append(tokens, tok)
+			p = p[end+1:]
+		default:
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			tokens = append(tokens, p[:end])
+			p = p[end:]
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,74 @@
+package jsonpath
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+		err  bool
+	}{
+		{path: "power", want: []string{"power"}},
+		{path: "emeters[0].power", want: []string{"emeters", "0", "power"}},
+		{path: "$.ENERGY.Voltage", want: []string{"ENERGY", "Voltage"}},
+		{path: "$['StatusSNS']['ENERGY']['Power']", want: []string{"StatusSNS", "ENERGY", "Power"}},
+		{path: `$["a.b"][ 1 ]`, want: []string{"a.b", "1"}},
+		{path: " $ ", want: nil},
+		{path: "a[0", err: true},
+		{path: "a[]", err: true},
+		{path: "a['']", err: true},
+	}
+	for _, test := range tests {
+		got, err := parse(test.path)
+		if (err != nil) != test.err {
+			t.Errorf("parse(%q) error = %v, want error %v", test.path, err, test.err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parse(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	doc, err := Decode([]byte(`{
+		"emeters": [{"power": 12.5}, {"power": "-3"}],
+		"ENERGY": {"Voltage": 230, "On": true, "Off": null, "Name": "plug", "Bad": "nan", "Big": "inf"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want float64
+		err  bool
+	}{
+		{path: "emeters[0].power", want: 12.5},
+		{path: "$.emeters[1].power", want: -3},
+		{path: "$['ENERGY']['Voltage']", want: 230},
+		{path: "ENERGY.On", want: 1},
+		{path: "ENERGY.Off", err: true},
+		{path: "ENERGY.Name", err: true},
+		{path: "ENERGY.Bad", err: true},
+		{path: "ENERGY.Big", err: true},
+		{path: "ENERGY", err: true},
+		{path: "ENERGY.Missing", err: true},
+		{path: "emeters[2].power", err: true},
+		{path: "emeters[-1].power", err: true},
+		{path: "emeters.power", err: true},
+		{path: "ENERGY.Voltage.Max", err: true},
+	}
+	for _, test := range tests {
+		got, err := Float(doc, test.path)
+		if (err != nil) != test.err {
+			t.Errorf("Float(%q) error = %v, want error %v", test.path, err, test.err)
+			continue
+		}
+		if !test.err && got != test.want {
+			t.Errorf("Float(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
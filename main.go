@@ -4,48 +4,70 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"os/signal"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	vc "victron_energymeter_mqtt/config"
 	"victron_energymeter_mqtt/dbustools"
+	"victron_energymeter_mqtt/jsonpath"
 	"victron_energymeter_mqtt/phase"
+	"victron_energymeter_mqtt/state"
+	"victron_energymeter_mqtt/subscriber"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-/* Configuration */
+/* Configuration, replaced as a whole by loadConfig. Read it with currentConfig() */
 var Config vc.Config
+var configMutex sync.RWMutex
+
+// serializes everything changing the config: reloads and settings written over the dbus
+var reloadMutex sync.Mutex
+
+const shutdownTimeout = 5 * time.Second
+
+// state is written periodically instead of on every value to spare the flash of the GX
+const stateSaveInterval = time.Minute
 
 var Cache sync.Map
-var totalMessages int
+
+// values that survive a restart, f.e. energy counter offsets
+var State *state.Store
+
+// the MQTT connection, guarded by reloadMutex as reloads change its subscriptions
+var Client subscriber.Subscriber
+
+// counters for the periodic log, only use with sync/atomic
+var totalMessages int64
+var malformedMessages int64
+var droppedReadings int64
+
+// never reset, for the heartbeat
+var receivedMessages int64
 
 // [string]phaseCache
 
 type phaseCache struct {
-	Field string
-	Valid bool
-	Phase *phase.SinglePhase
+	Field    string
+	Variable string // set instead of Field for variables used in expressions
+	JSONPath string
+	Phase    int // index into Meter.Lines
+	Meter    *Meter
 }
 
-var validLineImported map[string]*phase.SinglePhase
-var validLineExported map[string]*phase.SinglePhase
-
 func init() {
 
-	validLineImported = make(map[string]*phase.SinglePhase)
-	validLineExported = make(map[string]*phase.SinglePhase)
-
 	log.SetFormatter(&log.TextFormatter{
 		// DisableColors: true,
 		FullTimestamp: true,
@@ -58,91 +80,258 @@ func init() {
 	viper.AddConfigPath(".")                   // optionally look for config in the working directory
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		log.Info("Config changed!")
-		loadConfig()
+		if err := loadConfig(); err != nil {
+			log.WithField("error", err).Error("invalid config, keeping the previous one")
+		}
 	})
+
+	if err := loadConfig(); err != nil {
+		panic(fmt.Errorf("fatal error config file: %w", err))
+	}
+
+	setupMeters()
+	// reloads touch the meters, so they have to exist first
 	viper.WatchConfig()
 
-	Config.SetDefaults()
-	loadConfig()
+}
 
+/* the running config. It is never changed in place, the copy can be used without locking */
+func currentConfig() vc.Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return Config
 }
 
 func main() {
-	dbustools.Connect()
-	defer dbustools.Close()
-	log.Info("Successfully connected to dbus")
+	// cancelled by ctrl+c or SIGTERM
+	stop, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	// or by the update check, the service is restarted by its supervisor then
+	stop, quit := context.WithCancel(stop)
+	defer quit()
+	var exitCode int32
+	config := currentConfig()
+
+	for _, m := range Meters {
+		m.Service.Connect()
+		log.WithFields(log.Fields{"meter": m.Name(), "service": m.Service.Identity.ServiceName}).Info("Successfully connected to dbus")
+	}
 	// MQTT Subscripte
-	opts := mqtt.NewClientOptions()
-	opts.SetOrderMatters(false) //important or it will crash
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", Config.Mqtt.Broker, Config.Mqtt.Port))
-	opts.SetClientID(Config.Name + RandomString(10))
-	opts.SetUsername(Config.Mqtt.User)
-	opts.SetPassword(Config.Mqtt.Password)
-	opts.SetDefaultPublishHandler(messageHandler) //func that handles all messages
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.WithField("error", token.Error()).Panic("could not connect to MQTT server")
+	client, err := subscriber.New(subscriber.Options{
+		Config:           config.Mqtt,
+		ClientID:         config.Name + RandomString(10),
+		Subscriptions:    subscriptions,
+		OnMessage:        messageHandler, //func that handles all messages
+		OnConnect:        connectHandler,
+		OnConnectionLost: connectLostHandler,
+		StatusTopic:      config.Mqtt.Status.Topic,
+	})
+	if err != nil {
+		log.Panic(err)
 	}
-	func(client mqtt.Client) {
-		token := client.Subscribe(Config.Mqtt.Topic, 1, nil)
-		token.Wait()
-		log.Info("Subscribed to topic: " + Config.Mqtt.Topic)
-	}(client)
+	reloadMutex.Lock()
+	Client = client
+	reloadMutex.Unlock()
+	client.Connect(stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
-		logTicker := time.NewTicker(time.Second * time.Duration(Config.Logging.Interval))
-		for _ = range logTicker.C {
-			if Config.CheckForUpdates && totalMessages == 0 {
-				log.Fatal("No updates from MQTT topic. something is off ...")
+		logTicker := time.NewTicker(time.Second * time.Duration(config.Logging.Interval))
+		defer logTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-logTicker.C:
+			}
+			updates := atomic.SwapInt64(&totalMessages, 0)
+			malformed := atomic.SwapInt64(&malformedMessages, 0)
+			dropped := atomic.SwapInt64(&droppedReadings, 0)
+			c := currentConfig()
+			if c.CheckForUpdates && updates == 0 {
+				log.Error("No updates from MQTT topic. something is off ...")
+				atomic.StoreInt32(&exitCode, 1)
+				quit()
+				return
+			}
+			alive := log.WithFields(log.Fields{
+				"updates_sent": updates,
+				"malformed":    malformed,
+				"dropped":      dropped,
+			})
+			// with a status topic the heartbeat is the signal to watch
+			if c.Mqtt.Status.Topic != "" {
+				alive.Debug("still allive")
+			} else {
+				alive.Info("still allive")
+			}
+			for _, m := range Meters {
+				stats := m.Service.Stats()
+				log.WithFields(log.Fields{
+					"service":   m.Service.Identity.ServiceName,
+					"queued":    stats.Queued,
+					"coalesced": stats.Coalesced,
+					"dropped":   stats.Dropped,
+					"emitted":   stats.Emitted,
+					"batches":   stats.Batches,
+				}).Info("dbus queue")
 			}
-			log.WithField("updates_sent", totalMessages).Info("still allive")
-			totalMessages = 0
 		}
 	}()
 
-	if Config.Updates > 0 {
+	if config.Updates > 0 {
 		go func() {
-			updateTicker := time.NewTicker(time.Millisecond * time.Duration(Config.Updates))
-			log.WithField("ms", Config.Updates).Info("update interval set to delayed")
-			for _ = range updateTicker.C {
-				for _, ph := range phase.Lines {
-					UpdateDbusPhase(&ph)
+			updateTicker := time.NewTicker(time.Millisecond * time.Duration(config.Updates))
+			defer updateTicker.Stop()
+			log.WithField("ms", config.Updates).Info("update interval set to delayed")
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-updateTicker.C:
+				}
+				for _, m := range Meters {
+					m.UpdateDbus()
 				}
-				UpdateDbusGlobal()
 			}
 		}()
 	} else {
-		log.WithField("ms", Config.Updates).Info("update interval set to LIVE")
+		log.WithField("ms", config.Updates).Info("update interval set to LIVE")
+	}
+	var workers sync.WaitGroup
+	for _, m := range Meters {
+		workers.Add(1)
+		go func(m *Meter) {
+			defer workers.Done()
+			m.Service.Worker(ctx)
+		}(m)
+	}
+
+	if config.Mqtt.Status.Topic != "" {
+		go publishHeartbeats(ctx, client)
 	}
-	go dbustools.Worker(context.Background())
+
+	go func() {
+		staleTicker := time.NewTicker(time.Second)
+		defer staleTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-staleTicker.C:
+			}
+			for _, m := range Meters {
+				m.CheckStale()
+			}
+		}
+	}()
+
+	go func() {
+		saveTicker := time.NewTicker(stateSaveInterval)
+		defer saveTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-saveTicker.C:
+			}
+			if err := State.Save(); err != nil {
+				log.WithField("error", err).Warn("could not save state")
+			}
+		}
+	}()
 
 	// Wait for ctrl+c
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
-	<-done
-	os.Exit(0)
+	<-stop.Done()
+	log.Info("shutting down")
+	if !shutdown(client, cancel, &workers) {
+		log.Warn("shutdown timed out")
+		os.Exit(1)
+	}
+	log.Info("shutdown complete")
+	if code := atomic.LoadInt32(&exitCode); code != 0 {
+		os.Exit(int(code))
+	}
+}
+
+/*
+Stop everything in order: no more MQTT messages, stop tickers and workers (which drain
+their queues), tell the GX we are gone and release the dbus names
+*/
+func shutdown(client subscriber.Subscriber, cancel context.CancelFunc, workers *sync.WaitGroup) bool {
+	finished := make(chan struct{})
+	go func() {
+		client.Disconnect()
+		cancel()
+		workers.Wait()
+		if err := State.Save(); err != nil {
+			log.WithField("error", err).Warn("could not save state")
+		}
+		for _, m := range Meters {
+			m.Service.SetConnected(false)
+			m.Service.Close()
+		}
+		close(finished)
+	}()
 
+	select {
+	case <-finished:
+		return true
+	case <-time.After(shutdownTimeout):
+		return false
+	}
 }
 
 // ------------------------------------------------------------------------------------
 
-func loadConfig() {
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
-		panic(fmt.Errorf("fatal error config file: %w", err))
+/* read and validate the config file, the running config is only replaced if the new one is valid */
+func loadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	if err := viper.ReadInConfig(); err != nil { // Find and read the config file
+		return err
 	}
 
-	viper.Unmarshal(&Config)
-	Config.FixValues()
+	var c vc.Config
+	c.SetDefaults()
+	err := viper.Unmarshal(&c, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		phase.StringToTopicHookFunc(),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)))
+	if err != nil {
+		return err
+	}
+	c.FixValues()
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	// the state file is read once on startup
+	if State == nil {
+		var err error
+		State, err = state.Open(c.StateFile)
+		if err != nil {
+			log.WithFields(log.Fields{"file": c.StateFile, "error": err}).Warn("could not read state file, starting fresh")
+		}
+	}
+	applyDbusSettings(&c)
+	if err := resolveMeterIdentities(&c); err != nil {
+		return err
+	}
+	configMutex.Lock()
+	Config = c
+	configMutex.Unlock()
 
-	if Config.DryRun {
+	// the dbus connections are made once on startup
+	if Meters == nil && c.DryRun {
 		log.Warn("dry run / dbus disabled")
 		dbustools.DryRun = true
+	} else if c.DryRun != dbustools.DryRun {
+		log.Warn("dryrun changed, restart to apply")
 	}
 
-	switch Config.Logging.Level {
+	switch c.Logging.Level {
 	case "info":
 		log.SetLevel(log.InfoLevel)
 	case "debug":
@@ -155,156 +344,122 @@ func loadConfig() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Info(fmt.Sprintf("log interval set to %d", Config.Logging.Interval))
+	log.Info(fmt.Sprintf("log interval set to %d", c.Logging.Interval))
 
 	// -------- setup phases -----------
-	phase.Lines = Config.Phases
-	Cache = sync.Map{}
+	var sets []phase.TopicSet
+	for _, m := range c.Meters {
+		sets = append(sets, phase.TopicSet{Name: m.Name, Root: m.Topic, Lines: m.Phases})
+	}
+	for _, overlap := range phase.CheckOverlaps(sets...) {
+		log.Warn("topic overlap: " + overlap)
+	}
+	for _, topic := range unsubscribedTopics(&c) {
+		log.Warn("topic not covered by any subscription: " + topic)
+	}
+	if Meters != nil {
+		reloadMeters(&c)
+	}
+	Cache.Range(func(key, value interface{}) bool {
+		Cache.Delete(key)
+		return true
+	})
+	// topics of the phases may have changed, new messages are bound with the new config
+	if Client != nil {
+		if err := Client.Resubscribe(); err != nil {
+			log.WithField("error", err).Warn("could not update subscriptions, restart to apply")
+		}
+	}
+	return nil
 }
 
 /* Convert binary to float64 */
-func bin2Float64(bin string) float64 {
-	foostring := string(bin)
-	result, err := strconv.ParseFloat(foostring, 64)
+func bin2Float64(bin string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(bin), 64)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	return result
-}
-
-/* Called if connection is established */
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Info(fmt.Sprintf("Connected to broker"))
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("payload %q is not a finite number", bin)
+	}
+	return f, nil
 }
 
-/* Called if connection is lost  */
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	//panic and let the script restart
-	log.Panic(fmt.Sprintf("Connect lost: %v", err))
+/* Called if connection is established, also after every reconnect */
+func connectHandler() {
+	log.WithField("version", currentConfig().Mqtt.Version).Info("Connected to broker")
 }
 
-/* Search for string with regex */
-func IsPartOf(searchstring string, str string) bool {
-	out := strings.HasSuffix(str, searchstring)
-	// spew.Dump(str, searchstring, out)
-	return out
-	// return strings.Contains(str, searchstring)
+/* Called if connection is lost, the subscriber reconnects on its own */
+func connectLostHandler(err error) {
+	log.Warn(fmt.Sprintf("Connect lost: %v", err))
+	for _, m := range Meters {
+		m.Service.SetConnected(false)
+	}
 }
 
 // ##########################################################################################
 
-var messageHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Trace(fmt.Sprintf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic()))
-
-	payload := bin2Float64(string(msg.Payload()))
-	if _, ok := Cache.Load(msg.Topic()); !ok {
-		log.WithField("path", msg.Topic()).Trace("set cache for missing path")
-		//itterate through phases if not found in cache
-		for key := 0; key < len(phase.Lines); key++ {
-			ph := phase.Lines[key]
-
-			v := reflect.ValueOf(ph.Topics)
-			typeOfS := v.Type()
-
-			for i := 0; i < v.NumField(); i++ {
-				subtopic := v.Field(i).String()
-				if IsPartOf(subtopic, msg.Topic()) {
-					Cache.Store(msg.Topic(), phaseCache{
-						Field: typeOfS.Field(i).Name,
-						Valid: true,
-						Phase: &phase.Lines[key],
-					})
-					continue
-				}
-				// spew.Dump(typeOfS.Field(i).Name, v.Field(i).Interface())
-			}
+func messageHandler(msg subscriber.Message) {
+	log.Trace(fmt.Sprintf("Received message: %s from topic: %s\n", msg.Payload, msg.Topic))
+	atomic.AddInt64(&receivedMessages, 1)
 
+	if _, ok := Cache.Load(msg.Topic); !ok {
+		log.WithField("path", msg.Topic).Trace("set cache for missing path")
+		//itterate through phases of all meters if not found in cache
+		var bindings []phaseCache
+		for _, m := range Meters {
+			bindings = append(bindings, m.bindings(msg.Topic)...)
 		}
-		if _, ok := Cache.Load(msg.Topic()); !ok {
-			log.WithField("path", msg.Topic()).Trace("path not found, creating dummy")
-			Cache.Store(msg.Topic(), phaseCache{})
+		if len(bindings) == 0 {
+			log.WithField("path", msg.Topic).Trace("path not found, creating dummy")
 		}
+		Cache.Store(msg.Topic, bindings)
 	}
 
-	if tmp, ok := Cache.Load(msg.Topic()); ok {
-		ph := tmp.(phaseCache)
-		if ph.Valid {
-			log.WithField("path", msg.Topic()).Trace("cache found")
-
-			//handle Factors
-			switch ph.Field {
-			case "Imported":
-				payload = payload * Config.Factors.Imported
-			case "Exported":
-				payload = payload * Config.Factors.Exported
-			}
-
-			ph.Phase.SetByName(ph.Field, payload)
-			switch ph.Field {
-			case "Power":
-				dbustools.Queue(ph.Phase.Power, "W", "/Ac/"+ph.Phase.Name+"/Power")
-				UpdateDbusGlobal()
-			case "Voltage":
-				dbustools.Queue(ph.Phase.Voltage, "W", "/Ac/"+ph.Phase.Name+"/Voltage")
-			case "Current":
-				dbustools.Queue(ph.Phase.Current, "W", "/Ac/"+ph.Phase.Name+"/Current")
-			case "Exported":
-				dbustools.Queue(ph.Phase.Exported, "W", "/Ac/"+ph.Phase.Name+"/Energy/Forward")
-				validLineExported[ph.Phase.Name] = ph.Phase
-				// UpdateDbusGlobal()
-			case "Imported":
-				dbustools.Queue(ph.Phase.Imported, "W", "/Ac/"+ph.Phase.Name+"/Energy/Reverse")
-				validLineImported[ph.Phase.Name] = ph.Phase
-				// UpdateDbusGlobal()
-			}
-		}
+	tmp, ok := Cache.Load(msg.Topic)
+	if !ok {
+		return
 	}
 
-}
+	var doc interface{}
+	for _, ph := range tmp.([]phaseCache) {
+		log.WithField("path", msg.Topic).Trace("cache found")
+
+		payload, err := readPayload(msg.Payload, ph.JSONPath, &doc)
+		if err != nil {
+			atomic.AddInt64(&malformedMessages, 1)
+			log.WithFields(log.Fields{
+				"path":     msg.Topic,
+				"jsonpath": ph.JSONPath,
+				"payload":  string(msg.Payload),
+				"error":    err,
+			}).Warn("could not read value from payload")
+			continue
+		}
 
-func UpdateDbusPhase(uphase *phase.SinglePhase) {
-	if uphase != nil {
-		log.WithFields(log.Fields{
-			"Phase":    uphase.Name,
-			"Power":    uphase.Power,
-			"Current":  uphase.Current,
-			"Voltage":  uphase.Voltage,
-			"Exported": uphase.Exported,
-			"Imported": uphase.Imported,
-		}).Debug("values for " + uphase.Name)
-
-		dbustools.Queue(uphase.Power, "W", "/Ac/"+uphase.Name+"/Power")
-		dbustools.Queue(uphase.Current, "A", "/Ac/"+uphase.Name+"/Current")
-		dbustools.Queue(uphase.Voltage, "V", "/Ac/"+uphase.Name+"/Voltage")
-		dbustools.Queue(uphase.Exported, "kWh", "/Ac/"+uphase.Name+"/Energy/Forward")
-		dbustools.Queue(uphase.Imported, "kWh", "/Ac/"+uphase.Name+"/Energy/Reverse")
-		totalMessages++
+		if ph.Variable != "" {
+			ph.Meter.SetVariable(ph.Variable, payload)
+			continue
+		}
+		ph.Meter.SetValue(ph.Phase, ph.Field, payload, msg.Expires)
 	}
-}
 
-func UpdateDbusGlobal() {
-
-	var tKw float64
-	var tImported float64
-	var tExported float64
-	for _, ph := range phase.Lines {
-		tKw += ph.Power
-		tExported += ph.Exported
-		tImported += ph.Imported
-	}
+}
 
-	totalMessages++
-	dbustools.Queue(tKw, "W", "/Ac/Power")
-	log.WithFields(log.Fields{"W": tKw}).Debug("global Dbus update")
-	if len(validLineImported) >= len(phase.Lines) {
-		dbustools.Queue(tExported, "kWh", "/Ac/Energy/Forward") //imported from grid
-		log.WithFields(log.Fields{"forwared": tImported}).Debug("global Dbus update")
+/* Read a numeric value from the payload, either as bare number or from a JSON path */
+func readPayload(payload []byte, path string, doc *interface{}) (float64, error) {
+	if path == "" {
+		return bin2Float64(string(payload))
 	}
-	if len(validLineExported) >= len(phase.Lines) {
-		dbustools.Queue(tImported, "kWh", "/Ac/Energy/Reverse") //sold to grid
-		log.WithFields(log.Fields{"reverse": tExported}).Debug("global Dbus update")
+	if *doc == nil {
+		decoded, err := jsonpath.Decode(payload)
+		if err != nil {
+			return 0, err
+		}
+		*doc = decoded
 	}
-
+	return jsonpath.Float(*doc, path)
 }
 
 func RandomString(n int) string {
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"victron_energymeter_mqtt/subscriber"
+
+	"github.com/spf13/viper"
+)
+
+const raceConfig = `
+dryrun: true
+logging:
+  level: off
+statefile: %s
+stale:
+  timeout: 1
+  fields: [Power, Voltage]
+meters:
+  - name: test
+    topic: test
+    phases:
+      - name: L1
+        topics:
+          Power: l1/power
+          Voltage: l1/voltage
+          Imported: l1/total
+          Exported: l1/total_returned
+      - name: L2
+        topics:
+          Power: l2/power
+          Voltage: l2/voltage
+          Imported: l2/total
+          Exported: l2/total_returned
+`
+
+/* load config into the running globals like init does, with dry run meters */
+func setupTestMeters(t *testing.T, config string) {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "victron-mqtt-bridge.yaml")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf(config, filepath.Join(dir, "state"))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(file)
+	Meters = nil
+	State = nil
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	setupMeters()
+	for _, m := range Meters {
+		m.Service.Connect()
+	}
+}
+
+func publish(topic string, value float64) {
+	messageHandler(subscriber.Message{Topic: topic, Payload: []byte(strconv.FormatFloat(value, 'f', -1, 64))})
+}
+
+/* run with -race, MQTT messages, tickers, dbus reads and writes and config reloads all run on their own goroutines */
+func TestConcurrentUpdates(t *testing.T) {
+	setupTestMeters(t, raceConfig)
+	m := Meters[0]
+	// stale from the start, until the first voltage arrives
+	m.mutex.Lock()
+	m.started = time.Now().Add(-time.Hour)
+	m.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := make(chan struct{})
+	go func() {
+		m.Service.Worker(ctx)
+		close(worker)
+	}()
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				f(i)
+			}
+		}()
+	}
+	for _, line := range []string{"l1", "l2"} {
+		line := line
+		run(func(i int) {
+			publish("test/"+line+"/power", float64(i))
+			publish("test/"+line+"/total", float64(i))
+			publish("test/"+line+"/total_returned", float64(i))
+			if i >= 100 {
+				publish("test/"+line+"/voltage", 230)
+			}
+		})
+	}
+	run(func(int) { m.UpdateDbus() })
+	run(func(int) { m.CheckStale() })
+	run(func(int) {
+		m.Service.Value("/Ac/Power")
+		m.Service.Items()
+	})
+	run(func(int) {
+		subscriptions()
+		connectHandler()
+		newHeartbeat(time.Now())
+	})
+	run(func(i int) {
+		if i%20 != 0 {
+			return
+		}
+		if err := loadConfig(); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(i int) {
+		if i%20 != 0 {
+			return
+		}
+		if err := m.Service.OnSetValue("customname", "meter "+strconv.Itoa(i)); err != nil {
+			t.Error(err)
+		}
+	})
+	wg.Wait()
+
+	publish("test/l1/power", 100)
+	publish("test/l2/power", 50)
+	cancel()
+	<-worker
+
+	if !m.Service.IsConnected() {
+		t.Error("meter still disconnected after fresh values")
+	}
+	if power := m.Service.Value("/Ac/Power").Value(); power != 150.0 {
+		t.Errorf("/Ac/Power = %v, want 150", power)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if name := currentConfig().Meters[0].Dbus.CustomName; name != "meter 180" {
+		t.Errorf("custom name = %q after reload, want %q", name, "meter 180")
+	}
+}
+
+const directionConfig = `
+dryrun: true
+logging:
+  level: off
+statefile: %%s
+stale:
+  timeout: 1
+  fields: [Imported]
+meters:
+  - name: test
+    topic: test
+    invert: %t
+    phases:
+      - name: L1
+        topics:
+          Power: l1/power
+          Imported: l1/total
+          Exported: l1/total_returned
+        expressions:
+          ReactivePower: Power * 2
+`
+
+/* emit everything queued, the service can not queue anything afterwards */
+func flush(m *Meter) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Service.Worker(ctx)
+}
+
+func TestDirection(t *testing.T) {
+	tests := []struct {
+		invert           bool
+		forward, reverse float64
+		power            float64
+	}{
+		{invert: false, forward: 5, reverse: 2, power: 100},
+		{invert: true, forward: 2, reverse: 5, power: -100},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("invert=%t", test.invert), func(t *testing.T) {
+			setupTestMeters(t, fmt.Sprintf(directionConfig, test.invert))
+			m := Meters[0]
+			m.mutex.Lock()
+			m.started = time.Now().Add(-time.Hour)
+			m.mutex.Unlock()
+
+			// the stale fields are those of the source, even if they end up on the other path
+			publish("test/l1/total", 5)
+			m.mutex.Lock()
+			stale := m.staleFields(time.Now())
+			m.mutex.Unlock()
+			if len(stale) > 0 {
+				t.Errorf("stale fields %v right after an update", stale)
+			}
+
+			publish("test/l1/total_returned", 2)
+			publish("test/l1/power", 100)
+			flush(m)
+
+			want := map[string]float64{
+				"/Ac/L1/Energy/Forward": test.forward,
+				"/Ac/Energy/Forward":    test.forward,
+				"/Ac/L1/Energy/Reverse": test.reverse,
+				"/Ac/Energy/Reverse":    test.reverse,
+				"/Ac/L1/Power":          test.power,
+				"/Ac/Power":             test.power,
+				"/Ac/L1/ReactivePower":  test.power * 2, // computed after invert, not inverted again
+			}
+			for path, value := range want {
+				if got := m.Service.Value(path).Value(); got != value {
+					t.Errorf("%s = %v, want %v", path, got, value)
+				}
+			}
+
+		})
+	}
+}
+
+const expiryConfig = `
+dryrun: true
+logging:
+  level: off
+statefile: %s
+stale:
+  timeout: 60
+  fields: [Power]
+meters:
+  - name: test
+    topic: test
+    phases:
+      - name: L1
+        topics:
+          Power: l1/power
+          Frequency: l1/frequency
+`
+
+func expiring(topic string, payload string, expiry time.Duration) {
+	messageHandler(subscriber.Message{Topic: topic, Payload: []byte(payload), Expires: time.Now().Add(expiry)})
+}
+
+func TestExpiry(t *testing.T) {
+	setupTestMeters(t, expiryConfig)
+	m := Meters[0]
+	expiring("test/l1/power", "100", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	m.CheckStale()
+	if m.Service.IsConnected() {
+		t.Error("meter still connected with an expired power")
+	}
+	m.UpdateDbus()
+	flush(m)
+	if power := m.Service.Value("/Ac/L1/Power").Value(); power != 0.0 {
+		t.Errorf("/Ac/L1/Power = %v after expiry, want 0", power)
+	}
+
+	// recovers with a value that does not expire
+	publish("test/l1/power", 50)
+	if !m.Service.IsConnected() {
+		t.Error("meter still disconnected after a fresh power")
+	}
+}
+
+/* only the stale fields disconnect the meter, other expired fields are just not sent anymore */
+func TestExpiryOfOtherFields(t *testing.T) {
+	setupTestMeters(t, expiryConfig)
+	m := Meters[0]
+	expiring("test/l1/frequency", "50", 5*time.Millisecond)
+	publish("test/l1/power", 100)
+	time.Sleep(10 * time.Millisecond)
+
+	m.CheckStale()
+	if !m.Service.IsConnected() {
+		t.Error("meter disconnected by an expired frequency")
+	}
+
+	// the expired frequency does not keep the meter disconnected
+	expiring("test/l1/power", "100", 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	m.CheckStale()
+	if m.Service.IsConnected() {
+		t.Error("meter still connected with an expired power")
+	}
+	publish("test/l1/power", 50)
+	if !m.Service.IsConnected() {
+		t.Error("meter still disconnected after a fresh power with an expired frequency")
+	}
+}
+
+func TestNonFinitePayload(t *testing.T) {
+	setupTestMeters(t, fmt.Sprintf(directionConfig, false))
+	m := Meters[0]
+	publish("test/l1/power", 100)
+	for _, payload := range []string{"nan", "NaN", "inf", "-Inf"} {
+		malformed := atomic.LoadInt64(&malformedMessages)
+		messageHandler(subscriber.Message{Topic: "test/l1/power", Payload: []byte(payload)})
+		if got := atomic.LoadInt64(&malformedMessages); got != malformed+1 {
+			t.Errorf("%s: malformed messages = %d, want %d", payload, got, malformed+1)
+		}
+	}
+	flush(m)
+	if power := m.Service.Value("/Ac/L1/Power").Value(); power != 100.0 {
+		t.Errorf("/Ac/L1/Power = %v, want 100", power)
+	}
+}
+
+/* the dbus paths are registered on startup, a reload providing new fields is not applied */
+func TestReloadNewPaths(t *testing.T) {
+	setupTestMeters(t, expiryConfig)
+	m := Meters[0]
+	config := strings.Replace(fmt.Sprintf(expiryConfig, currentConfig().StateFile), "          Frequency: l1/frequency\n", "          Frequency: l1/frequency\n          ReactivePower: l1/reactive\n", 1)
+	if err := os.WriteFile(viper.ConfigFileUsed(), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	m.mutex.Lock()
+	provides := m.Lines[0].Provides("ReactivePower")
+	m.mutex.Unlock()
+	if provides {
+		t.Error("reactive power applied without a dbus path")
+	}
+}
+
+/* settings changed over the dbus survive a restart without touching the config file */
+func TestDbusSettings(t *testing.T) {
+	setupTestMeters(t, expiryConfig)
+	file, err := os.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Meters[0]
+	if err := m.Service.OnSetValue("customname", "Garage"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Service.OnSetValue("position", 1); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(viper.ConfigFileUsed()); string(after) != string(file) {
+		t.Errorf("config file changed to\n%s", after)
+	}
+
+	Meters = nil
+	State = nil
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if dbus := currentConfig().Meters[0].Dbus; dbus.CustomName != "Garage" || dbus.Position != 1 {
+		t.Errorf("custom name %q, position %d after restart, want %q, 1", dbus.CustomName, dbus.Position, "Garage")
+	}
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vc "victron_energymeter_mqtt/config"
+	"victron_energymeter_mqtt/dbustools"
+	"victron_energymeter_mqtt/phase"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Meter is a single virtual meter on the dbus, fed by its own phases.
+// Config, Lines and the valid line maps are guarded by mutex, they are written
+// from the MQTT handler and read by the update ticker and config reloads.
+type Meter struct {
+	Config  vc.MeterConfig
+	Lines   []phase.SinglePhase
+	Service *dbustools.Service
+
+	mutex             sync.Mutex
+	validLineImported map[string]*phase.SinglePhase
+	validLineExported map[string]*phase.SinglePhase
+
+	// time of the last value per "<phase>.<field>", used to detect stale data
+	started    time.Time
+	lastUpdate map[string]time.Time
+	stale      bool
+	// expiry of values from messages with a message expiry interval, per "<phase>.<field>" as sent to the dbus
+	expires map[string]time.Time
+
+	// energy counters per "<phase>/<field>", kept across config reloads and restarts
+	counters map[string]*phase.Counter
+	// energy integrated from power per phase, same as counters
+	integrators map[string]*phase.Integrator
+
+	// plausibility filters per "<phase>/<field>" and smoothing of the power per phase
+	filters   map[string]*phase.Filter
+	smoothers map[string]*phase.Smoother
+
+	// fields computed from expressions and the last values of the variables they use
+	computed     []phase.Computed
+	variables    map[string]float64
+	computeDepth int
+}
+
+var Meters []*Meter
+
+func NewMeter(c vc.MeterConfig) *Meter {
+	m := &Meter{
+		Service:           dbustools.NewService(c.Dbus, c.Phases),
+		validLineImported: make(map[string]*phase.SinglePhase),
+		validLineExported: make(map[string]*phase.SinglePhase),
+		counters:          make(map[string]*phase.Counter),
+		integrators:       make(map[string]*phase.Integrator),
+		variables:         make(map[string]float64),
+	}
+	m.setConfig(c)
+	return m
+}
+
+/* take over the config, the phases are reset to their configured default values if they changed */
+func (m *Meter) setConfig(c vc.MeterConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.filters = make(map[string]*phase.Filter)
+	m.smoothers = make(map[string]*phase.Smoother)
+	// the config is validated already
+	m.computed, _ = phase.Compile(c.Phases, c.Variables)
+	if m.Lines != nil && reflect.DeepEqual(m.Config.Phases, c.Phases) {
+		m.Config = c
+		return
+	}
+	m.Config = c
+	m.Lines = make([]phase.SinglePhase, len(c.Phases))
+	copy(m.Lines, c.Phases)
+	m.validLineImported = make(map[string]*phase.SinglePhase)
+	m.validLineExported = make(map[string]*phase.SinglePhase)
+	m.started = time.Now()
+	m.lastUpdate = make(map[string]time.Time)
+	m.expires = make(map[string]time.Time)
+
+	// phases integrating power continue with their stored energy
+	for i := range m.Lines {
+		ph := &m.Lines[i]
+		if !ph.Integrate {
+			continue
+		}
+		in := m.integrator(ph.Name)
+		ph.Imported = in.Imported
+		ph.Exported = in.Exported
+		m.validLineImported[ph.Name] = ph
+		m.validLineExported[ph.Name] = ph
+	}
+}
+
+func (m *Meter) Name() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Config.Name
+}
+
+func phaseNames(phases []phase.SinglePhase) (names []string) {
+	for _, ph := range phases {
+		names = append(names, ph.Name)
+	}
+	return
+}
+
+/* create a meter for every configured one */
+func setupMeters() {
+	Meters = nil
+	for i, c := range currentConfig().Meters {
+		m := NewMeter(c)
+		m.Service.OnSetValue = m.persistDbusSetting(i)
+		Meters = append(Meters, m)
+	}
+}
+
+/*
+Keep settings changed over the dbus (f.e. /CustomName from the GUI) in the state store.
+The config file is left alone, the stored values win over it on every load (see applyDbusSettings)
+*/
+func (m *Meter) persistDbusSetting(index int) dbustools.SetValueHandler {
+	return func(key string, value interface{}) error {
+		reloadMutex.Lock()
+		defer reloadMutex.Unlock()
+		c := currentConfig()
+		if index >= len(c.Meters) {
+			return fmt.Errorf("meter %d not found in config", index)
+		}
+		if err := State.Set(dbusSettingKey(c.Meters[index].Name, key), value); err != nil {
+			return err
+		}
+		if err := State.Save(); err != nil {
+			return err
+		}
+
+		// keep the running config in sync so the reload does not see a changed identity
+		m.mutex.Lock()
+		m.Config.Dbus.Set(key, value)
+		m.mutex.Unlock()
+		c.Meters = append([]vc.MeterConfig(nil), c.Meters...)
+		c.Meters[index].Dbus.Set(key, value)
+		configMutex.Lock()
+		Config = c
+		configMutex.Unlock()
+		return nil
+	}
+}
+
+func dbusSettingKey(meter string, key string) string {
+	return meter + "/dbus/" + key
+}
+
+/* take over the settings changed over the dbus, before the identities are resolved */
+func applyDbusSettings(c *vc.Config) {
+	for i := range c.Meters {
+		m := &c.Meters[i]
+		var name string
+		if State.Get(dbusSettingKey(m.Name, "customname"), &name) {
+			m.Dbus.CustomName = name
+		}
+		var position int
+		if State.Get(dbusSettingKey(m.Name, "position"), &position) {
+			m.Dbus.Position = position
+		}
+	}
+}
+
+/* apply a changed config to the running meters, the dbus identity is only read on startup */
+func reloadMeters(c *vc.Config) {
+	if len(Meters) != len(c.Meters) {
+		log.Warn("number of meters changed, restart to apply")
+		return
+	}
+	for i, m := range Meters {
+		m.mutex.Lock()
+		current := m.Config
+		m.mutex.Unlock()
+		if current.Dbus != c.Meters[i].Dbus {
+			log.WithField("meter", current.Name).Warn("dbus settings changed, restart to apply")
+		}
+		if !reflect.DeepEqual(phaseNames(current.Phases), phaseNames(c.Meters[i].Phases)) {
+			log.WithField("meter", current.Name).Warn("phases changed, restart to apply")
+			continue
+		}
+		if !reflect.DeepEqual(dbustools.Paths(current.Phases), dbustools.Paths(c.Meters[i].Phases)) {
+			log.WithField("meter", current.Name).Warn("provided fields changed, restart to apply")
+			continue
+		}
+		m.setConfig(c.Meters[i])
+	}
+}
+
+/* resolve the dbus identity of all meters, make sure they do not collide and their phases are valid */
+func resolveMeterIdentities(c *vc.Config) error {
+	names := make(map[string]string)
+	for i := range c.Meters {
+		m := &c.Meters[i]
+		if err := dbustools.ValidatePhases(phaseNames(m.Phases)); err != nil {
+			return fmt.Errorf("meter %s: %w", m.Name, err)
+		}
+		id, err := dbustools.ResolveIdentity(m.Dbus)
+		if err != nil {
+			return fmt.Errorf("meter %s: %w", m.Name, err)
+		}
+		if other, ok := names[id.ServiceName]; ok {
+			return fmt.Errorf("meter %s: dbus servicename %s already used by meter %s", m.Name, id.ServiceName, other)
+		}
+		names[id.ServiceName] = m.Name
+		m.Dbus = id
+	}
+	return nil
+}
+
+/* topics to subscribe to with their QoS, for the running config */
+func subscriptions() map[string]byte {
+	c := currentConfig()
+	return subscriptionsOf(&c)
+}
+
+/*
+Either the configured subscriptions or exactly the topics of all meters,
+without those already covered by a wildcard topic
+*/
+func subscriptionsOf(c *vc.Config) map[string]byte {
+	topics := make(map[string]byte)
+	if len(c.Mqtt.Subscriptions) > 0 {
+		for _, s := range c.Mqtt.Subscriptions {
+			topics[s.Topic] = s.QoS
+		}
+		return topics
+	}
+	for _, pattern := range neededTopics(c) {
+		topics[pattern] = c.Mqtt.QoS
+	}
+	for topic := range topics {
+		for other := range topics {
+			if other != topic && phase.Covers(other, topic) {
+				delete(topics, topic)
+				break
+			}
+		}
+	}
+	return topics
+}
+
+/* full topic patterns of all phases and variables of all meters */
+func neededTopics(c *vc.Config) (patterns []string) {
+	for _, mc := range c.Meters {
+		for _, ph := range mc.Phases {
+			for _, t := range ph.Patterns(mc.Topic) {
+				patterns = append(patterns, t.Topic)
+			}
+		}
+		for _, t := range mc.Variables {
+			patterns = append(patterns, t.Pattern(mc.Topic))
+		}
+	}
+	return
+}
+
+/* topics of the config no subscription delivers, only possible with configured subscriptions */
+func unsubscribedTopics(c *vc.Config) (missing []string) {
+	topics := subscriptionsOf(c)
+	for _, pattern := range neededTopics(c) {
+		covered := false
+		for topic := range topics {
+			if phase.Covers(topic, pattern) {
+				covered = true
+			}
+		}
+		if !covered {
+			missing = append(missing, pattern)
+		}
+	}
+	return
+}
+
+/* all phase fields of this meter that are fed by the given topic */
+func (m *Meter) bindings(topic string) (bindings []phaseCache) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key := 0; key < len(m.Lines); key++ {
+		ph := m.Lines[key]
+
+		v := reflect.ValueOf(ph.Topics)
+		typeOfS := v.Type()
+
+		for i := 0; i < v.NumField(); i++ {
+			t := v.Field(i).Interface().(phase.Topic)
+			if t.IsSet() && phase.Match(t.Pattern(ph.Root(m.Config.Topic)), topic) {
+				bindings = append(bindings, phaseCache{
+					Field:    typeOfS.Field(i).Name,
+					JSONPath: t.JSONPath,
+					Phase:    key,
+					Meter:    m,
+				})
+			}
+		}
+	}
+	for name, t := range m.Config.Variables {
+		if phase.Match(t.Pattern(m.Config.Topic), topic) {
+			bindings = append(bindings, phaseCache{
+				Variable: name,
+				JSONPath: t.JSONPath,
+				Meter:    m,
+			})
+		}
+	}
+	return
+}
+
+/* set a single value received from MQTT and pass it on to the dbus */
+func (m *Meter) SetValue(line int, field string, payload float64, expires time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if line >= len(m.Lines) {
+		// phases changed since the binding was cached
+		return
+	}
+	ph := &m.Lines[line]
+
+	//handle transforms, the global factors are used if the topic has none
+	if t := ph.Topics.Get(field); t.HasTransform() {
+		payload = t.Transform(payload)
+	} else {
+		switch field {
+		case "Imported":
+			payload = payload * m.Config.Factors.Imported
+		case "Exported":
+			payload = payload * m.Config.Factors.Exported
+		}
+	}
+	m.setValue(line, field, payload, expires, false)
+}
+
+/* set a variable received from MQTT and update the fields computed from it */
+func (m *Meter) SetVariable(name string, payload float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t, ok := m.Config.Variables[name]
+	if !ok {
+		// variables changed since the binding was cached
+		return
+	}
+	if t.HasTransform() {
+		payload = t.Transform(payload)
+	}
+	m.variables[name] = payload
+	m.compute("$" + name)
+}
+
+/*
+set a transformed value, from MQTT or an expression, m.mutex must be held. expires is zero if the value does not expire.
+Computed values are already in the direction model of the dbus, they are not inverted again
+*/
+func (m *Meter) setValue(line int, field string, payload float64, expires time.Time, computed bool) {
+	ph := &m.Lines[line]
+	if !m.plausible(ph.Name, field, payload) {
+		atomic.AddInt64(&droppedReadings, 1)
+		return
+	}
+	if field == "Imported" || field == "Exported" {
+		payload = m.count(ph.Name, field, payload)
+	}
+	// freshness is tracked by the field of the source, like the stale fields are configured
+	m.lastUpdate[ph.Name+"."+field] = time.Now()
+	if !computed {
+		field, payload = m.direction(field, payload)
+	}
+	if field == "Power" {
+		payload = m.smooth(ph.Name, payload)
+	}
+
+	ph.SetByName(field, payload)
+	if expires.IsZero() {
+		delete(m.expires, ph.Name+"."+field)
+	} else {
+		m.expires[ph.Name+"."+field] = expires
+	}
+	defer m.compute(ph.Name + "." + field)
+	if !m.Service.IsConnected() && len(m.staleFields(time.Now())) == 0 {
+		log.WithField("meter", m.Config.Name).Info("receiving data again")
+		m.stale = false
+		m.Service.SetConnected(true)
+	}
+	if field == "Frequency" {
+		m.UpdateDbusFrequency()
+		return
+	}
+	m.Service.Queue(payload, dbustools.PhasePath(ph.Name, field))
+	if field == "Power" && ph.Integrate {
+		m.integrate(ph)
+	}
+	if len(ph.Derive) > 0 {
+		m.derive(ph)
+	}
+	switch field {
+	case "Power":
+		m.UpdateDbusGlobal()
+	case "Exported":
+		m.validLineExported[ph.Name] = ph
+		// UpdateDbusGlobal()
+	case "Imported":
+		m.validLineImported[ph.Name] = ph
+		// UpdateDbusGlobal()
+	}
+}
+
+/* time of the last value per "<phase>.<field>" */
+func (m *Meter) LastUpdates() map[string]time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	last := make(map[string]time.Time, len(m.lastUpdate))
+	for key, t := range m.lastUpdate {
+		last[key] = t
+	}
+	return last
+}
+
+/* check a reading against the limits of its field, m.mutex must be held */
+func (m *Meter) plausible(line string, field string, value float64) bool {
+	limit, ok := m.Config.Limits[field]
+	if !ok {
+		return true
+	}
+	logger := log.WithFields(log.Fields{"meter": m.Config.Name, "phase": line, "field": field, "value": value})
+	if (limit.Min != nil && value < *limit.Min) || (limit.Max != nil && value > *limit.Max) {
+		logger.Debug("reading out of range, dropped")
+		return false
+	}
+	key := line + "/" + field
+	f, ok := m.filters[key]
+	if !ok {
+		f = &phase.Filter{}
+		m.filters[key] = f
+	}
+	if !f.Accept(value, time.Now(), limit.MaxRate) {
+		logger.Debug("reading changed too fast, dropped")
+		return false
+	}
+	return true
+}
+
+/* smooth the power of a phase if configured, m.mutex must be held */
+func (m *Meter) smooth(line string, power float64) float64 {
+	smoothing := m.Config.Smoothing
+	if smoothing == nil || smoothing.Mode == "" {
+		return power
+	}
+	s, ok := m.smoothers[line]
+	if !ok {
+		s = &phase.Smoother{}
+		m.smoothers[line] = s
+	}
+	if smoothing.Mode == "median" {
+		return s.Median(power, smoothing.Window)
+	}
+	return s.EMA(power, smoothing.Window)
+}
+
+/* queue the values derived from the new reading of a phase, m.mutex must be held */
+func (m *Meter) derive(ph *phase.SinglePhase) {
+	for _, field := range ph.DeriveValues() {
+		m.Service.Queue(ph.GetByName(field), dbustools.PhasePath(ph.Name, field))
+		if field == "Power" {
+			if ph.Integrate {
+				m.integrate(ph)
+			}
+			m.UpdateDbusGlobal()
+		}
+		m.compute(ph.Name + "." + field)
+	}
+}
+
+// expressions depending on each other can not loop (see phase.Compile), but derived values could
+const maxComputeDepth = 10
+
+/* evaluate all expressions using the value behind key ("<phase>.<field>" or "$<variable>"), m.mutex must be held */
+func (m *Meter) compute(key string) {
+	if m.computeDepth >= maxComputeDepth {
+		log.WithFields(log.Fields{"meter": m.Config.Name, "input": key}).Warn("expressions nested too deep, stopped")
+		return
+	}
+	m.computeDepth++
+	defer func() { m.computeDepth-- }()
+
+	for _, c := range m.computed {
+		if !c.Uses(key) || c.Line >= len(m.Lines) {
+			continue
+		}
+		value, err := c.Expr.Eval(func(name string) (float64, bool) {
+			return m.input(c.Inputs[name])
+		})
+		if err != nil {
+			log.WithFields(log.Fields{"meter": m.Config.Name, "phase": m.Lines[c.Line].Name, "field": c.Field, "error": err}).Debug("could not compute value")
+			continue
+		}
+		m.setValue(c.Line, c.Field, value, time.Time{}, true)
+	}
+}
+
+/* current value of an expression input, m.mutex must be held */
+func (m *Meter) input(key string) (float64, bool) {
+	if strings.HasPrefix(key, "$") {
+		v, ok := m.variables[key[1:]]
+		return v, ok
+	}
+	i := strings.Index(key, ".")
+	for j := range m.Lines {
+		if m.Lines[j].Name == key[:i] {
+			return m.Lines[j].GetByName(key[i+1:]), true
+		}
+	}
+	return 0, false
+}
+
+/* keep the energy counters monotonic across resets of the source meter, m.mutex must be held */
+func (m *Meter) count(line string, field string, raw float64) float64 {
+	key := line + "/" + field
+	c, ok := m.counters[key]
+	if !ok {
+		c = &phase.Counter{}
+		State.Get(m.stateKey(key), c)
+		m.counters[key] = c
+	}
+
+	value, reset := c.Update(raw, m.Config.Counters.Tolerance, m.Config.Counters.Rollover)
+	if err := State.Set(m.stateKey(key), c); err != nil {
+		log.WithFields(log.Fields{"key": m.stateKey(key), "error": err}).Warn("could not store counter")
+	}
+	if reset {
+		log.WithFields(log.Fields{
+			"meter":  m.Config.Name,
+			"phase":  line,
+			"field":  field,
+			"raw":    raw,
+			"offset": c.Offset,
+		}).Warn("energy counter was reset, continuing with offset")
+		if err := State.Save(); err != nil {
+			log.WithField("error", err).Warn("could not save state")
+		}
+	}
+	return value
+}
+
+/* integrator of a phase, restored from the state store on first use, m.mutex must be held */
+func (m *Meter) integrator(line string) *phase.Integrator {
+	in, ok := m.integrators[line]
+	if !ok {
+		in = &phase.Integrator{}
+		State.Get(m.stateKey(line+"/integrated"), in)
+		m.integrators[line] = in
+	}
+	return in
+}
+
+/* integrate the power of a phase into its Imported/Exported energy, m.mutex must be held */
+func (m *Meter) integrate(ph *phase.SinglePhase) {
+	in := m.integrator(ph.Name)
+	in.Add(ph.Power, time.Now())
+	if err := State.Set(m.stateKey(ph.Name+"/integrated"), in); err != nil {
+		log.WithFields(log.Fields{"key": m.stateKey(ph.Name + "/integrated"), "error": err}).Warn("could not store integrated energy")
+	}
+
+	ph.Imported = in.Imported
+	ph.Exported = in.Exported
+	m.Service.Queue(ph.Imported, dbustools.PhasePath(ph.Name, "Imported"))
+	m.Service.Queue(ph.Exported, dbustools.PhasePath(ph.Name, "Exported"))
+	m.validLineImported[ph.Name] = ph
+	m.validLineExported[ph.Name] = ph
+	m.compute(ph.Name + ".Imported")
+	m.compute(ph.Name + ".Exported")
+}
+
+/* key of a value of this meter in the state store */
+func (m *Meter) stateKey(key string) string {
+	return m.Config.Name + "/" + key
+}
+
+/*
+Map a value of the source meter onto the direction model of the dbus (see fieldPaths in dbustools).
+With invert, power flows the other way and the import/export counters are swapped
+*/
+func (m *Meter) direction(field string, value float64) (string, float64) {
+	if !m.Config.Invert {
+		return field, value
+	}
+	switch field {
+	case "Power", "Current", "ReactivePower":
+		return field, -value
+	case "Imported":
+		return "Exported", value
+	case "Exported":
+		return "Imported", value
+	}
+	return field, value
+}
+
+/* true if the value of a field, as sent to the dbus, came with a message expiry that is over, m.mutex must be held */
+func (m *Meter) expired(line string, field string, now time.Time) bool {
+	expires, ok := m.expires[line+"."+field]
+	return ok && !now.Before(expires)
+}
+
+/* stale fields whose value expired or is older than the stale timeout, m.mutex must be held */
+func (m *Meter) staleFields(now time.Time) (stale []string) {
+	timeout := time.Second * time.Duration(m.Config.Stale.Timeout)
+	for _, ph := range m.Lines {
+		for _, field := range m.Config.Stale.Fields {
+			if !ph.Provides(field) {
+				continue
+			}
+			// other fields that expire are only not sent anymore
+			if sent, _ := m.direction(field, 0); m.expired(ph.Name, sent, now) {
+				stale = append(stale, ph.Name+"."+field)
+				continue
+			}
+			if m.Config.Stale.Timeout == 0 {
+				continue
+			}
+			last, ok := m.lastUpdate[ph.Name+"."+field]
+			if !ok {
+				last = m.started
+			}
+			if now.Sub(last) > timeout {
+				stale = append(stale, ph.Name+"."+field)
+			}
+		}
+	}
+	return
+}
+
+/*
+Mark the meter disconnected if its data is stale, so the GX does not regulate against old values.
+Power and current are zeroed and no energy is integrated across the outage,
+the meter recovers with the next fresh value in SetValue
+*/
+func (m *Meter) CheckStale() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stale := m.staleFields(time.Now())
+	if len(stale) == 0 || m.stale {
+		return
+	}
+
+	log.WithFields(log.Fields{"meter": m.Config.Name, "fields": stale}).Warn("data is stale, marking meter disconnected")
+	m.stale = true
+	m.Service.SetConnected(false)
+	for i := range m.Lines {
+		m.Lines[i].Power = 0
+		m.Lines[i].Current = 0
+		m.Service.Queue(0, dbustools.PhasePath(m.Lines[i].Name, "Power"))
+		m.Service.Queue(0, dbustools.PhasePath(m.Lines[i].Name, "Current"))
+		if in, ok := m.integrators[m.Lines[i].Name]; ok {
+			in.Reset()
+		}
+	}
+	m.UpdateDbusGlobal()
+}
+
+/* periodic update of all values, used if updates are delayed */
+func (m *Meter) UpdateDbus() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.Lines {
+		m.UpdateDbusPhase(&m.Lines[i])
+	}
+	m.UpdateDbusGlobal()
+}
+
+/* m.mutex must be held by the caller, same for the other UpdateDbus* functions */
+func (m *Meter) UpdateDbusPhase(uphase *phase.SinglePhase) {
+	if uphase != nil {
+		log.WithFields(log.Fields{
+			"Meter":    m.Config.Name,
+			"Phase":    uphase.Name,
+			"Power":    uphase.Power,
+			"Current":  uphase.Current,
+			"Voltage":  uphase.Voltage,
+			"Exported": uphase.Exported,
+			"Imported": uphase.Imported,
+		}).Debug("values for " + uphase.Name)
+
+		fields := []string{"Power", "Current", "Voltage", "Exported", "Imported"}
+		if uphase.Provides("PowerFactor") || uphase.Derives("PowerFactor") {
+			fields = append(fields, "PowerFactor")
+		}
+		if uphase.Provides("ReactivePower") {
+			fields = append(fields, "ReactivePower")
+		}
+		now := time.Now()
+		for _, field := range fields {
+			// an expired value is outdated, it is not sent again
+			if !m.expired(uphase.Name, field, now) {
+				m.Service.Queue(uphase.GetByName(field), dbustools.PhasePath(uphase.Name, field))
+			}
+		}
+		atomic.AddInt64(&totalMessages, 1)
+	}
+}
+
+/* average frequency of all phases that provide one, without expired ones */
+func (m *Meter) UpdateDbusFrequency() {
+	var sum float64
+	var count int
+	now := time.Now()
+	for _, ph := range m.Lines {
+		if ph.Provides("Frequency") && !m.expired(ph.Name, "Frequency", now) {
+			sum += ph.Frequency
+			count++
+		}
+	}
+	if count > 0 {
+		m.Service.Queue(sum/float64(count), "/Ac/Frequency")
+	}
+}
+
+func (m *Meter) UpdateDbusGlobal() {
+
+	var tKw float64
+	var tImported float64
+	var tExported float64
+	for _, ph := range m.Lines {
+		tKw += ph.Power
+		tExported += ph.Exported
+		tImported += ph.Imported
+	}
+
+	atomic.AddInt64(&totalMessages, 1)
+	m.Service.Queue(tKw, "/Ac/Power")
+	log.WithFields(log.Fields{"meter": m.Config.Name, "W": tKw}).Debug("global Dbus update")
+	m.UpdateDbusFrequency()
+	// see fieldPaths in dbustools for the direction model
+	if len(m.validLineImported) >= len(m.Lines) {
+		m.Service.Queue(tImported, "/Ac/Energy/Forward") //imported from grid
+		log.WithFields(log.Fields{"meter": m.Config.Name, "forward": tImported}).Debug("global Dbus update")
+	}
+	if len(m.validLineExported) >= len(m.Lines) {
+		m.Service.Queue(tExported, "/Ac/Energy/Reverse") //sold to grid
+		log.WithFields(log.Fields{"meter": m.Config.Name, "reverse": tExported}).Debug("global Dbus update")
+	}
+
+}
@@ -0,0 +1,35 @@
+package phase
+
+// Counter turns a cumulative energy reading, which may be reset (f.e. a rebooted Shelly)
+// or roll over, into a monotonically increasing value
+type Counter struct {
+	Offset float64 `json:"offset"` // added to every raw reading
+	Last   float64 `json:"last"`   // last raw reading
+	Value  float64 `json:"value"`  // last presented value
+	Valid  bool    `json:"valid"`
+}
+
+/*
+Update the counter with a new raw reading. A reading more than tolerance below the last one is
+a reset, if rollover is set (the value the meter wraps at) it is taken as a rollover instead
+*/
+func (c *Counter) Update(raw float64, tolerance float64, rollover float64) (value float64, reset bool) {
+	if c.Valid && raw < c.Last-tolerance {
+		reset = true
+		if rollover > 0 {
+			c.Offset += rollover
+		} else {
+			c.Offset += c.Last
+		}
+	}
+	c.Last = raw
+	c.Valid = true
+
+	value = raw + c.Offset
+	if value < c.Value {
+		// small jitter backwards within the tolerance, never present a decrease
+		value = c.Value
+	}
+	c.Value = value
+	return
+}
@@ -0,0 +1,36 @@
+package phase
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	tests := []struct {
+		name                string
+		raws                []float64
+		tolerance, rollover float64
+		want                []float64
+		resets              []bool
+	}{
+		{"increasing", []float64{1, 2, 3}, 0, 0, []float64{1, 2, 3}, []bool{false, false, false}},
+		{"reset", []float64{10, 12, 1, 3}, 0, 0, []float64{10, 12, 13, 15}, []bool{false, false, true, false}},
+		{"rollover", []float64{98, 99, 2}, 0, 100, []float64{98, 99, 102}, []bool{false, false, true}},
+		{"jitter within tolerance", []float64{10, 9.5, 11}, 1, 0, []float64{10, 10, 11}, []bool{false, false, false}},
+		{"drop beyond tolerance", []float64{10, 8.5}, 1, 0, []float64{10, 18.5}, []bool{false, true}},
+		{"first reading", []float64{0}, 0, 0, []float64{0}, []bool{false}},
+	}
+	for _, test := range tests {
+		var c Counter
+		var values []float64
+		var resets []bool
+		for _, raw := range test.raws {
+			value, reset := c.Update(raw, test.tolerance, test.rollover)
+			values = append(values, value)
+			resets = append(resets, reset)
+		}
+		if !reflect.DeepEqual(values, test.want) || !reflect.DeepEqual(resets, test.resets) {
+			t.Errorf("%s: values %v, resets %v, want %v, %v", test.name, values, resets, test.want, test.resets)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package phase
+
+import "math"
+
+// fields that can be computed from the other electrical values of a phase
+var DerivableFields = []string{"Power", "Current", "Voltage", "PowerFactor"}
+
+/* a field is derived if it is listed in Derive and not mapped to a topic or expression */
+func (s *SinglePhase) Derives(field string) bool {
+	if s.mapped(field) {
+		return false
+	}
+	return s.derives(field)
+}
+
+func (s *SinglePhase) derives(field string) bool {
+	for _, f := range s.Derive {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SinglePhase) mapped(field string) bool {
+	return s.Provides(field)
+}
+
+/*
+fill in the derived fields from the mapped ones and returns the fields that changed.
+only mapped values are used as input, a missing power factor counts as 1.
+a listed Current that is mapped only gets the sign of the power.
+*/
+func (s *SinglePhase) DeriveValues() (changed []string) {
+	set := func(field string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) || s.GetByName(field) == value {
+			return
+		}
+		s.SetByName(field, value)
+		changed = append(changed, field)
+	}
+	pf := 1.0
+	if s.mapped("PowerFactor") && s.PowerFactor != 0 {
+		pf = math.Abs(s.PowerFactor)
+	}
+	p, i, u := s.mapped("Power"), s.mapped("Current"), s.mapped("Voltage")
+
+	if s.Derives("Power") && u && i {
+		set("Power", s.Voltage*s.Current*pf)
+	}
+	if s.Derives("Current") && p && u {
+		if s.Voltage == 0 {
+			set("Current", 0)
+		} else {
+			set("Current", s.Power/(s.Voltage*pf))
+		}
+	}
+	if s.derives("Current") && i && s.Power != 0 && (s.Current < 0) != (s.Power < 0) {
+		set("Current", -s.Current)
+	}
+	if s.Derives("Voltage") && p && i && s.Current != 0 {
+		set("Voltage", math.Abs(s.Power/(s.Current*pf)))
+	}
+	if s.Derives("PowerFactor") && p && u && i && s.Voltage*s.Current != 0 {
+		set("PowerFactor", math.Min(1, math.Abs(s.Power/(s.Voltage*s.Current))))
+	}
+	return
+}
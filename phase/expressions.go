@@ -0,0 +1,140 @@
+package phase
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"victron_energymeter_mqtt/expr"
+)
+
+// Computed is a phase field calculated from an expression
+type Computed struct {
+	Line   int    // index of the phase
+	Field  string // f.e. "Power"
+	Expr   *expr.Expr
+	Inputs map[string]string // name in the expression -> "<phase>.<field>" or "$<variable>"
+}
+
+/* canonical field name of a phase value, f.e. "power" -> "Power" */
+func FieldName(name string) (string, bool) {
+	topics := reflect.TypeOf(Topics{})
+	for i := 0; i < topics.NumField(); i++ {
+		if strings.EqualFold(topics.Field(i).Name, name) {
+			return topics.Field(i).Name, true
+		}
+	}
+	return name, false
+}
+
+/* a field is provided if it is mapped to a topic or computed by an expression */
+func (s *SinglePhase) Provides(field string) bool {
+	if s.Topics.Get(field).IsSet() {
+		return true
+	}
+	_, ok := s.Expressions[field]
+	return ok
+}
+
+/* resolve a name used in an expression of phases[line] to "<phase>.<field>" or "$<variable>" */
+func resolveName(name string, line int, phases []SinglePhase, variables map[string]Topic) (string, error) {
+	if _, ok := variables[strings.ToLower(name)]; ok {
+		return "$" + strings.ToLower(name), nil
+	}
+	ph, field := phases[line].Name, name
+	if i := strings.Index(name, "."); i >= 0 {
+		ph, field = name[:i], name[i+1:]
+		found := false
+		for _, p := range phases {
+			if strings.EqualFold(p.Name, ph) {
+				ph, found = p.Name, true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("unknown phase %q in %q", ph, name)
+		}
+	}
+	field, ok := FieldName(field)
+	if !ok {
+		return "", fmt.Errorf("unknown variable or field %q", name)
+	}
+	return ph + "." + field, nil
+}
+
+/*
+Parse the expressions of all phases and resolve their inputs. A field can not have a topic and an
+expression, and expressions must not depend on themselves
+*/
+func Compile(phases []SinglePhase, variables map[string]Topic) (computed []Computed, err error) {
+	for name := range variables {
+		if _, ok := FieldName(name); ok || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("variable %q can not be named like a field or contain a dot", name)
+		}
+	}
+
+	deps := make(map[string][]string)
+	for line, ph := range phases {
+		for field, source := range ph.Expressions {
+			if _, ok := FieldName(field); !ok {
+				return nil, fmt.Errorf("phase %s: unknown expression field %q", ph.Name, field)
+			}
+			if ph.Topics.Get(field).IsSet() {
+				return nil, fmt.Errorf("phase %s: %s has a topic and an expression", ph.Name, field)
+			}
+			e, err := expr.Parse(source)
+			if err != nil {
+				return nil, fmt.Errorf("phase %s: %s: %w", ph.Name, field, err)
+			}
+			c := Computed{Line: line, Field: field, Expr: e, Inputs: make(map[string]string)}
+			for _, name := range e.Names() {
+				key, err := resolveName(name, line, phases, variables)
+				if err != nil {
+					return nil, fmt.Errorf("phase %s: %s: %w", ph.Name, field, err)
+				}
+				c.Inputs[name] = key
+				deps[ph.Name+"."+field] = append(deps[ph.Name+"."+field], key)
+			}
+			computed = append(computed, c)
+		}
+	}
+
+	// depth first search for cycles
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("expression for %s depends on itself", key)
+		case done:
+			return nil
+		}
+		state[key] = visiting
+		for _, dep := range deps[key] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[key] = done
+		return nil
+	}
+	for key := range deps {
+		if err := visit(key); err != nil {
+			return nil, err
+		}
+	}
+	return computed, nil
+}
+
+/* the expression has to be evaluated again if the value behind key changed */
+func (c Computed) Uses(key string) bool {
+	for _, k := range c.Inputs {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package phase
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Filter drops readings that change faster than allowed, f.e. a single 65535 W glitch.
+// A jump is only accepted if the next reading confirms it.
+type Filter struct {
+	last      float64
+	lastTime  time.Time
+	candidate float64
+	pending   bool
+}
+
+/* check a reading against the maximum change per second, a rejected reading is kept as candidate */
+func (f *Filter) Accept(value float64, now time.Time, maxRate float64) bool {
+	if maxRate <= 0 || f.lastTime.IsZero() || f.within(f.last, value, now, maxRate) ||
+		(f.pending && f.within(f.candidate, value, now, maxRate)) {
+		f.last = value
+		f.lastTime = now
+		f.pending = false
+		return true
+	}
+	f.candidate = value
+	f.pending = true
+	return false
+}
+
+func (f *Filter) within(from float64, to float64, now time.Time, maxRate float64) bool {
+	// at least a second, readings arriving in bursts would be rejected otherwise
+	seconds := math.Max(now.Sub(f.lastTime).Seconds(), 1)
+	return math.Abs(to-from) <= maxRate*seconds
+}
+
+// Smoother averages a value over the last readings, either as median or as exponential moving average
+type Smoother struct {
+	window []float64
+	ema    float64
+	primed bool
+}
+
+/* median of the last size readings including value */
+func (s *Smoother) Median(value float64, size int) float64 {
+	s.window = append(s.window, value)
+	if len(s.window) > size {
+		s.window = s.window[len(s.window)-size:]
+	}
+	sorted := append([]float64(nil), s.window...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+/* exponential moving average, size is the number of readings of the equivalent simple average */
+func (s *Smoother) EMA(value float64, size int) float64 {
+	if !s.primed {
+		s.ema = value
+		s.primed = true
+		return value
+	}
+	alpha := 2 / (float64(size) + 1)
+	s.ema += alpha * (value - s.ema)
+	return s.ema
+}
@@ -0,0 +1,59 @@
+package phase
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		values   []float64
+		step     time.Duration
+		maxRate  float64
+		accepted []bool
+	}{
+		{"no limit", []float64{0, 65535}, time.Second, 0, []bool{true, true}},
+		{"within rate", []float64{0, 50, 150}, time.Second, 100, []bool{true, true, true}},
+		{"glitch", []float64{100, 65535, 110}, time.Second, 100, []bool{true, false, true}},
+		{"confirmed jump", []float64{100, 1000, 1010}, time.Second, 100, []bool{true, false, true}},
+		{"unconfirmed jumps", []float64{100, 1000, 2000, 3000}, time.Second, 100, []bool{true, false, false, false}},
+		{"burst", []float64{0, 90, 180}, 100 * time.Millisecond, 100, []bool{true, true, true}},
+	}
+	for _, test := range tests {
+		var f Filter
+		var accepted []bool
+		for n, value := range test.values {
+			accepted = append(accepted, f.Accept(value, start.Add(time.Duration(n)*test.step), test.maxRate))
+		}
+		if !reflect.DeepEqual(accepted, test.accepted) {
+			t.Errorf("%s: accepted %v, want %v", test.name, accepted, test.accepted)
+		}
+	}
+}
+
+func TestSmoother(t *testing.T) {
+	tests := []struct {
+		name   string
+		smooth func(s *Smoother, value float64) float64
+		values []float64
+		want   []float64
+	}{
+		{"median", func(s *Smoother, v float64) float64 { return s.Median(v, 3) }, []float64{1, 5, 3, 100, 4}, []float64{1, 3, 3, 5, 4}},
+		{"median of one", func(s *Smoother, v float64) float64 { return s.Median(v, 1) }, []float64{1, 5}, []float64{1, 5}},
+		{"ema", func(s *Smoother, v float64) float64 { return s.EMA(v, 3) }, []float64{10, 20, 20}, []float64{10, 15, 17.5}},
+		{"ema of one", func(s *Smoother, v float64) float64 { return s.EMA(v, 1) }, []float64{10, 20}, []float64{10, 20}},
+	}
+	for _, test := range tests {
+		var s Smoother
+		var got []float64
+		for _, value := range test.values {
+			got = append(got, test.smooth(&s, value))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package phase
+
+import (
+	"math"
+	"time"
+)
+
+// gaps between two power readings longer than this are not integrated, the data is missing
+const MaxIntegrationGap = 5 * time.Minute
+
+// Integrator sums up signed power over time into import and export energy,
+// for meters that only publish power
+type Integrator struct {
+	Imported float64 `json:"imported"` // kWh, positive power
+	Exported float64 `json:"exported"` // kWh, negative power
+
+	lastPower float64
+	lastTime  time.Time
+}
+
+/* add a power reading in W, the energy since the last reading is integrated with the trapezoidal rule */
+func (i *Integrator) Add(power float64, now time.Time) {
+	if math.IsNaN(power) || math.IsInf(power, 0) {
+		return
+	}
+	if !i.lastTime.IsZero() {
+		dt := now.Sub(i.lastTime)
+		if dt > 0 && dt <= MaxIntegrationGap {
+			i.addSegment(i.lastPower, power, dt.Hours())
+		}
+	}
+	i.lastPower = power
+	i.lastTime = now
+}
+
+/* forget the last reading, f.e. after an outage, the next reading starts a new segment */
+func (i *Integrator) Reset() {
+	i.lastPower = 0
+	i.lastTime = time.Time{}
+}
+
+/* energy of a linear power segment from p1 to p2, split at the zero crossing */
+func (i *Integrator) addSegment(p1 float64, p2 float64, hours float64) {
+	if (p1 >= 0) == (p2 >= 0) {
+		i.book((p1 + p2) / 2 * hours)
+		return
+	}
+	// sign changes within the segment, book both parts into their own counter
+	t0 := hours * p1 / (p1 - p2)
+	i.book(p1 / 2 * t0)
+	i.book(p2 / 2 * (hours - t0))
+}
+
+func (i *Integrator) book(wh float64) {
+	if wh >= 0 {
+		i.Imported += wh / 1000
+	} else {
+		i.Exported += -wh / 1000
+	}
+}
@@ -0,0 +1,33 @@
+package phase
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIntegrator(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name               string
+		powers             []float64
+		step               time.Duration
+		imported, exported float64
+	}{
+		{"constant import", []float64{1000, 1000, 1000}, 3 * time.Minute, 0.1, 0},
+		{"constant export", []float64{-2000, -2000}, 3 * time.Minute, 0, 0.1},
+		{"zero crossing", []float64{1000, -1000}, 3 * time.Minute, 0.0125, 0.0125},
+		{"gap", []float64{1000, 1000}, MaxIntegrationGap + time.Second, 0, 0},
+		{"not a number", []float64{1000, math.NaN(), 1000}, time.Minute, 1.0 / 30, 0},
+		{"infinite", []float64{1000, math.Inf(1), math.Inf(-1), 1000}, time.Minute, 0.05, 0},
+	}
+	for _, test := range tests {
+		var in Integrator
+		for n, power := range test.powers {
+			in.Add(power, start.Add(time.Duration(n)*test.step))
+		}
+		if math.Abs(in.Imported-test.imported) > 1e-9 || math.Abs(in.Exported-test.exported) > 1e-9 {
+			t.Errorf("%s: imported %v, exported %v, want %v, %v", test.name, in.Imported, in.Exported, test.imported, test.exported)
+		}
+	}
+}
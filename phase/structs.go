@@ -2,93 +2,81 @@ package phase
 
 import (
 	"reflect"
-	"strconv"
 
-	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"github.com/mitchellh/mapstructure"
 )
 
-var Lines []SinglePhase
+// Topic maps an MQTT topic to a single value. If JSONPath is set, the payload
+// is decoded as JSON and the value is taken from that path instead.
+// The value can be transformed before it is used, see transform.go
+type Topic struct {
+	Topic    string `json:"topic,omitempty"`
+	JSONPath string `json:"jsonpath,omitempty"`
+	Absolute bool   `json:"absolute,omitempty"` // the topic is used as it is, not relative to the root
+
+	Unit     string  `json:"unit,omitempty"`     // named conversion, f.e. "Wh->kWh"
+	Multiply float64 `json:"multiply,omitempty"` // 0: not set
+	Add      float64 `json:"add,omitempty"`
+	Negate   bool    `json:"negate,omitempty"`
+}
 
 type Topics struct {
-	Voltage  string `json:"voltage,omitempty"`
-	Current  string `json:"current,omitempty"`
-	Power    string `json:"power,omitempty"`
-	Imported string `json:"imported,omitempty"`
-	Exported string `json:"exported,omitempty"`
+	Voltage  Topic `json:"voltage,omitempty"`
+	Current  Topic `json:"current,omitempty"`
+	Power    Topic `json:"power,omitempty"`
+	Imported Topic `json:"imported,omitempty"`
+	Exported Topic `json:"exported,omitempty"`
+
+	// optional, only exported to the dbus if set
+	Frequency     Topic `json:"frequency,omitempty"`
+	PowerFactor   Topic `json:"powerfactor,omitempty"`
+	ReactivePower Topic `json:"reactivepower,omitempty"`
 }
 type SinglePhase struct {
 	Name     string  `json:"name,omitempty"`
+	Topic    string  `json:"topic,omitempty"`    // topic root for relative topics, default: topic of the meter
 	Voltage  float64 `json:"voltage,omitempty"`  // Volts: 230,0
 	Current  float64 `json:"current,omitempty"`  // Amps: 8,3
 	Power    float64 `json:"power,omitempty"`    // Watts: 1909
 	Imported float64 `json:"imported,omitempty"` // kWh, purchased power
 	Exported float64 `json:"exported,omitempty"` // kWh, sold power
 
+	Frequency     float64 `json:"frequency,omitempty"`     // Hz: 50,0
+	PowerFactor   float64 `json:"powerfactor,omitempty"`   // cos phi: 0,95
+	ReactivePower float64 `json:"reactivepower,omitempty"` // var: 120
+
 	Topics Topics `json:"topics,omitempty"`
+
+	Integrate bool     `json:"integrate,omitempty"` // compute Imported/Exported from Power if the meter has no counters
+	Derive    []string `json:"derive,omitempty"`    // fields computed from the others if they are not mapped, see derive.go
+
+	Expressions map[string]string `json:"expressions,omitempty"` // field -> expression, see expressions.go
 }
 
 func init() {
 
 }
 
+/* a topic is set if it is mapped to an MQTT topic */
+func (t Topic) IsSet() bool {
+	return t.Topic != ""
+}
+
 func (i *SinglePhase) SetByName(propName string, propValue float64) *SinglePhase {
 	reflect.ValueOf(i).Elem().FieldByName(propName).Set(reflect.ValueOf(propValue))
 	return i
 }
 
-func (s *SinglePhase) FixValues() {
-	// if s.Voltage == 0 {
-	// 	log.Trace("Voltage missing, setting default value of 230")
-	// 	s.Voltage = 230
-	// }
-	if s.Power != 0 && s.Current == 0 {
-		log.Trace("current missing, calculating value")
-		s.Current = s.Power / s.Voltage
-	}
-	// if s.Current != 0 && s.Power == 0 {
-	// 	log.Debug("power missing, calculating value")
-	// 	s.Power = s.Voltage * s.Current
-	// }
+func (i *SinglePhase) GetByName(propName string) float64 {
+	return reflect.ValueOf(i).Elem().FieldByName(propName).Float()
 }
 
-func LoadConfig() {
-	for i := 1; i < 10; i++ {
-		var lineName = "l" + strconv.Itoa(i)
-		var lineVals = viper.GetStringMap(lineName)
-		log.Trace("getting config for " + lineName)
-		if len(lineVals) == 0 && lineName == "l1" {
-			log.Panic("at least L1 required in config")
-		} else if len(lineVals) == 0 {
-			log.Trace("no more sequential Lines configured")
-			return //no more configs
-		}
-
-		if len(lineVals) == 0 {
-			Lines = append(Lines, SinglePhase{
-				Name:    "L" + strconv.Itoa(i),
-				Voltage: Lines[0].Voltage,
-			})
-		} else {
-			topics := lineVals["topic"].(map[string]interface{})
-			Lines = append(Lines, SinglePhase{
-				Name:     "L" + strconv.Itoa(i),
-				Voltage:  lineVals["voltage"].(float64),
-				Current:  lineVals["current"].(float64),
-				Power:    lineVals["power"].(float64),
-				Imported: lineVals["imported"].(float64),
-				Exported: lineVals["exported"].(float64),
-
-				Topics: Topics{
-					Voltage:  topics["voltage"].(string),
-					Power:    topics["power"].(string),
-					Current:  topics["current"].(string),
-					Imported: topics["imported"].(string),
-					Exported: topics["exported"].(string),
-				},
-			})
+/* allows topics to be configured as plain strings, f.e. "Power: 0/power" */
+func StringToTopicHookFunc() mapstructure.DecodeHookFunc {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(Topic{}) {
+			return data, nil
 		}
-
+		return Topic{Topic: data.(string)}, nil
 	}
-
 }
@@ -0,0 +1,171 @@
+package phase
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+Resolve the full topic pattern. Absolute topics and topics already starting with root
+are taken as they are, everything else is relative to root
+*/
+func (t Topic) Pattern(root string) string {
+	if t.Absolute || root == "" || t.Topic == root || strings.HasPrefix(t.Topic, root+"/") {
+		return t.Topic
+	}
+	return root + "/" + t.Topic
+}
+
+/* topic root of the phase, its own one or the root of the meter */
+func (s SinglePhase) Root(meter string) string {
+	if s.Topic != "" {
+		return TopicRoot(s.Topic)
+	}
+	return meter
+}
+
+/* full topic patterns of all mapped fields of the phase, by field name */
+func (s SinglePhase) Patterns(meter string) map[string]Topic {
+	patterns := make(map[string]Topic)
+	v := reflect.ValueOf(s.Topics)
+	for i := 0; i < v.NumField(); i++ {
+		t := v.Field(i).Interface().(Topic)
+		if !t.IsSet() {
+			continue
+		}
+		t.Topic = t.Pattern(s.Root(meter))
+		patterns[v.Type().Field(i).Name] = t
+	}
+	return patterns
+}
+
+/* Root of a subscription, f.e. "shellies/3em/emeter/#" -> "shellies/3em/emeter" */
+func TopicRoot(subscription string) string {
+	root := strings.TrimSuffix(subscription, "#")
+	return strings.TrimSuffix(root, "/")
+}
+
+/* Check if topic is matched exactly by an MQTT pattern, which may contain + and # wildcards */
+func Match(pattern string, topic string) bool {
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+
+	// wildcards at the first level do not match $SYS and friends
+	if strings.HasPrefix(topic, "$") && (p[0] == "+" || p[0] == "#") {
+		return false
+	}
+
+	for i, level := range p {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+/* Check if pattern a matches every topic pattern b matches, so a subscription to a makes b redundant */
+func Covers(a string, b string) bool {
+	pa := strings.Split(a, "/")
+	pb := strings.Split(b, "/")
+
+	// wildcards at the first level do not match $SYS and friends
+	if (pa[0] == "+" || pa[0] == "#") && strings.HasPrefix(pb[0], "$") {
+		return false
+	}
+
+	for i, level := range pa {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(pb), pb[i] == "#":
+			return false
+		case level == "+":
+			continue
+		case pb[i] == "+", level != pb[i]:
+			return false
+		}
+	}
+	return len(pa) == len(pb)
+}
+
+/* Check if there is any topic that is matched by both patterns */
+func Overlaps(a string, b string) bool {
+	pa := strings.Split(a, "/")
+	pb := strings.Split(b, "/")
+
+	for i := 0; ; i++ {
+		switch {
+		case i < len(pa) && pa[i] == "#", i < len(pb) && pb[i] == "#":
+			return true
+		case i >= len(pa) && i >= len(pb):
+			return true
+		case i >= len(pa):
+			// "a/#" also matches "a"
+			return i == len(pb)-1 && pb[i] == "#"
+		case i >= len(pb):
+			return i == len(pa)-1 && pa[i] == "#"
+		case pa[i] != "+" && pb[i] != "+" && pa[i] != pb[i]:
+			return false
+		}
+	}
+}
+
+type binding struct {
+	name    string
+	pattern string
+	path    string
+}
+
+// TopicSet are the phases of a single meter with the root their topics are relative to
+type TopicSet struct {
+	Name  string
+	Root  string
+	Lines []SinglePhase
+}
+
+/*
+Report every pair of phase fields whose patterns can match the same topic.
+Fields reading different JSON paths of the same message do not count as overlapping
+*/
+func CheckOverlaps(sets ...TopicSet) (overlaps []string) {
+	var all []binding
+	for _, set := range sets {
+		for _, ph := range set.Lines {
+			patterns := ph.Patterns(set.Root)
+			fields := make([]string, 0, len(patterns))
+			for field := range patterns {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				topic := patterns[field]
+				all = append(all, binding{
+					name:    set.Name + "/" + ph.Name + "." + field,
+					pattern: topic.Topic,
+					path:    topic.JSONPath,
+				})
+			}
+		}
+	}
+
+	for i := 0; i < len(all); i++ {
+		for j := i + 1; j < len(all); j++ {
+			if all[i].path != all[j].path && all[i].path != "" && all[j].path != "" {
+				continue
+			}
+			if Overlaps(all[i].pattern, all[j].pattern) {
+				overlaps = append(overlaps, fmt.Sprintf("%s (%s) overlaps with %s (%s)",
+					all[i].name, all[i].pattern, all[j].name, all[j].pattern))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package phase
+
+import "testing"
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/+", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/+/c", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+	for _, test := range tests {
+		if got := Covers(test.a, test.b); got != test.want {
+			t.Errorf("Covers(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		topic Topic
+		want  string
+	}{
+		{Topic{Topic: "1/power"}, "shellies/3em/1/power"},
+		{Topic{Topic: "shellies/3em/1/power"}, "shellies/3em/1/power"},
+		{Topic{Topic: "tasmota/plug/power", Absolute: true}, "tasmota/plug/power"},
+		{Topic{Topic: "/tasmota/plug/power", Absolute: true}, "/tasmota/plug/power"},
+		{Topic{Topic: "/power"}, "shellies/3em//power"},
+	}
+	for _, test := range tests {
+		if got := test.topic.Pattern("shellies/3em"); got != test.want {
+			t.Errorf("Pattern(%+v) = %q, want %q", test.topic, got, test.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+	for _, test := range tests {
+		if got := Match(test.pattern, test.topic); got != test.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.pattern, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "+/b", true},
+		{"a/+/c", "a/b/+", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/#", "a", true},
+		{"a", "a/#", true},
+		{"#", "a/b", true},
+		{"a/#", "b/#", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b/c", false},
+	}
+	for _, test := range tests {
+		if got := Overlaps(test.a, test.b); got != test.want {
+			t.Errorf("Overlaps(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := Overlaps(test.b, test.a); got != test.want {
+			t.Errorf("Overlaps(%q, %q) = %v, want %v", test.b, test.a, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package phase
+
+import (
+	"reflect"
+	"strings"
+)
+
+// named unit conversions for Topic.Unit
+var Units = map[string]float64{
+	"Wh->kWh":   0.001,
+	"kWh->Wh":   1000,
+	"W->kW":     0.001,
+	"kW->W":     1000,
+	"mA->A":     0.001,
+	"mV->V":     0.001,
+	"kvar->var": 1000,
+	"mHz->Hz":   0.001,
+}
+
+/* factor of a named unit conversion, names are not case sensitive */
+func UnitFactor(name string) (float64, bool) {
+	for unit, factor := range Units {
+		if strings.EqualFold(unit, name) {
+			return factor, true
+		}
+	}
+	return 0, false
+}
+
+/* a topic has a transform if any of unit, multiply, add or negate is set */
+func (t Topic) HasTransform() bool {
+	return t.Unit != "" || t.Multiply != 0 || t.Add != 0 || t.Negate
+}
+
+/* convert the unit, then multiply, add and negate */
+func (t Topic) Transform(value float64) float64 {
+	if factor, ok := UnitFactor(t.Unit); ok {
+		value *= factor
+	}
+	if t.Multiply != 0 {
+		value *= t.Multiply
+	}
+	value += t.Add
+	if t.Negate {
+		value = -value
+	}
+	return value
+}
+
+/* topic of a field by its name, f.e. "Power" */
+func (t Topics) Get(field string) Topic {
+	v := reflect.ValueOf(t).FieldByName(field)
+	if !v.IsValid() {
+		return Topic{}
+	}
+	return v.Interface().(Topic)
+}
@@ -0,0 +1,94 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store keeps values that have to survive a restart (f.e. counter offsets) in a JSON file
+type Store struct {
+	path  string
+	mutex sync.Mutex
+	data  map[string]json.RawMessage
+	dirty bool
+}
+
+/* Open the store, a missing file is not an error and just starts empty */
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: make(map[string]json.RawMessage),
+	}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+/* Decode the value stored under key into v, returns false if there is none */
+func (s *Store) Get(key string, v interface{}) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	raw, ok := s.data[key]
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+/* Remember v under key, it is written on the next Save */
+func (s *Store) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data[key] = raw
+	s.dirty = true
+	return nil
+}
+
+/* Write the store to disk if anything changed, replacing the file atomically */
+func (s *Store) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"victron_energymeter_mqtt/subscriber"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var started = time.Now()
+
+// heartbeat is published retained to <status topic>/heartbeat
+type heartbeat struct {
+	Time        time.Time              `json:"time"`
+	Uptime      int64                  `json:"uptime"`   // seconds
+	Messages    int64                  `json:"messages"` // MQTT messages received
+	DbusUpdates uint64                 `json:"dbus_updates"`
+	Meters      map[string]meterStatus `json:"meters"`
+}
+
+type meterStatus struct {
+	Connected  bool                 `json:"connected"`
+	LastValues map[string]time.Time `json:"last_values"` // by "<phase>.<field>"
+}
+
+func newHeartbeat(now time.Time) heartbeat {
+	hb := heartbeat{
+		Time:     now,
+		Uptime:   int64(now.Sub(started).Seconds()),
+		Messages: atomic.LoadInt64(&receivedMessages),
+		Meters:   make(map[string]meterStatus),
+	}
+	for _, m := range Meters {
+		hb.DbusUpdates += m.Service.Stats().Emitted
+		hb.Meters[m.Name()] = meterStatus{
+			Connected:  m.Service.IsConnected(),
+			LastValues: m.LastUpdates(),
+		}
+	}
+	return hb
+}
+
+/* publish the heartbeat every status interval until ctx is cancelled */
+func publishHeartbeats(ctx context.Context, client subscriber.Subscriber) {
+	status := currentConfig().Mqtt.Status
+	topic := status.Topic + "/heartbeat"
+	ticker := time.NewTicker(time.Second * time.Duration(status.Interval))
+	defer ticker.Stop()
+	for {
+		payload, err := json.Marshal(newHeartbeat(time.Now()))
+		if err != nil {
+			log.WithField("error", err).Warn("could not encode heartbeat")
+		} else if err := client.Publish(topic, payload, true); err != nil {
+			log.WithFields(log.Fields{"topic": topic, "error": err}).Warn("could not publish heartbeat")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
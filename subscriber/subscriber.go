@@ -0,0 +1,90 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	vc "victron_energymeter_mqtt/config"
+)
+
+// Message is a received MQTT message, independent of the protocol version
+type Message struct {
+	Topic   string
+	Payload []byte
+	Expires time.Time // zero if the message does not expire, MQTT v5 only
+}
+
+type Options struct {
+	Config   vc.MqttConfig
+	ClientID string
+
+	Subscriptions    func() map[string]byte // topic -> QoS, subscribed on every (re)connect
+	StatusTopic      string                 // gets a retained online on connect and offline as Last Will, empty disables
+	OnMessage        func(Message)
+	OnConnect        func()
+	OnConnectionLost func(error)
+}
+
+const (
+	Online  = "online"
+	Offline = "offline"
+)
+
+// Subscriber is a connection to the broker, reconnecting on its own once connected
+type Subscriber interface {
+	// connect to the broker, retrying until it is reachable (f.e. at boot) or ctx is cancelled
+	Connect(ctx context.Context)
+	// publish offline to the status topic and disconnect
+	Disconnect()
+	// publish with QoS 1
+	Publish(topic string, payload []byte, retain bool) error
+	// subscribe to new topics and unsubscribe from removed ones, f.e. after a config reload
+	Resubscribe() error
+}
+
+/* create a subscriber for the configured protocol version */
+func New(opts Options) (Subscriber, error) {
+	tlsConfig, err := opts.Config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Config.Version {
+	case 3:
+		return newV3(opts, tlsConfig), nil
+	case 5:
+		return newV5(opts, tlsConfig)
+	}
+	return nil, fmt.Errorf("mqtt: unknown version %d", opts.Config.Version)
+}
+
+/* shared subscriptions are a v5 feature, the broker spreads the messages over all clients of the group */
+func (o Options) topics() map[string]byte {
+	topics := o.Subscriptions()
+	if o.Config.ShareGroup == "" {
+		return topics
+	}
+	shared := make(map[string]byte, len(topics))
+	for topic, qos := range topics {
+		shared["$share/"+o.Config.ShareGroup+"/"+topic] = qos
+	}
+	return shared
+}
+
+/* changes to get from the current to the wanted subscriptions, a topic with a changed QoS is subscribed again */
+func diff(current map[string]byte, wanted map[string]byte) (subscribe map[string]byte, unsubscribe []string) {
+	subscribe = make(map[string]byte)
+	for topic, qos := range wanted {
+		if q, ok := current[topic]; !ok || q != qos {
+			subscribe[topic] = qos
+		}
+	}
+	for topic := range current {
+		if _, ok := wanted[topic]; !ok {
+			unsubscribe = append(unsubscribe, topic)
+		}
+	}
+	sort.Strings(unsubscribe)
+	return
+}
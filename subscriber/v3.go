@@ -0,0 +1,148 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// v3 speaks MQTT 3.1.1 through paho.mqtt.golang
+type v3 struct {
+	opts   Options
+	client mqtt.Client
+
+	mutex      sync.Mutex
+	subscribed map[string]byte // since the last connect
+}
+
+func newV3(opts Options, tlsConfig *tls.Config) *v3 {
+	s := &v3{opts: opts}
+	c := opts.Config
+
+	o := mqtt.NewClientOptions()
+	o.SetOrderMatters(false) //important or it will crash
+	o.AddBroker(c.BrokerURL())
+	if tlsConfig != nil {
+		o.SetTLSConfig(tlsConfig)
+	}
+	if opts.StatusTopic != "" {
+		o.SetWill(opts.StatusTopic, Offline, 1, true)
+	}
+	o.SetClientID(opts.ClientID)
+	o.SetUsername(c.User)
+	o.SetPassword(c.Password)
+	o.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		opts.OnMessage(Message{Topic: msg.Topic(), Payload: msg.Payload()})
+	})
+	o.SetAutoReconnect(true)
+	o.SetMaxReconnectInterval(time.Second * time.Duration(c.ReconnectInterval))
+	o.OnConnect = s.onConnect
+	o.OnConnectionLost = func(client mqtt.Client, err error) {
+		opts.OnConnectionLost(err)
+	}
+	o.OnReconnecting = func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		log.Info("Reconnecting to broker")
+	}
+	s.client = mqtt.NewClient(o)
+	return s
+}
+
+func (s *v3) Connect(ctx context.Context) {
+	backoff := time.Second
+	maxBackoff := time.Second * time.Duration(s.opts.Config.ReconnectInterval)
+	for {
+		token := s.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		log.WithFields(log.Fields{"error": token.Error(), "retry_in": backoff}).Warn("could not connect to MQTT server")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *v3) Disconnect() {
+	// the Last Will is not sent on a clean disconnect
+	if s.opts.StatusTopic != "" && s.client.IsConnected() {
+		if err := s.Publish(s.opts.StatusTopic, []byte(Offline), true); err != nil {
+			log.WithField("error", err).Warn("could not publish status")
+		}
+	}
+	s.client.Disconnect(250)
+}
+
+func (s *v3) Publish(topic string, payload []byte, retain bool) error {
+	return wait(s.client.Publish(topic, 1, retain, payload), "publish to "+topic)
+}
+
+func (s *v3) Resubscribe() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.client.IsConnectionOpen() || s.subscribed == nil {
+		// everything is subscribed on the next connect
+		return nil
+	}
+	subscribe, unsubscribe := diff(s.subscribed, s.opts.topics())
+	if len(unsubscribe) > 0 {
+		if err := wait(s.client.Unsubscribe(unsubscribe...), "unsubscribe"); err != nil {
+			return err
+		}
+		for _, topic := range unsubscribe {
+			delete(s.subscribed, topic)
+			log.Info("Unsubscribed from topic: " + topic)
+		}
+	}
+	if len(subscribe) > 0 {
+		if err := wait(s.client.SubscribeMultiple(subscribe, nil), "subscribe"); err != nil {
+			return err
+		}
+		for topic, qos := range subscribe {
+			s.subscribed[topic] = qos
+			log.Info("Subscribed to topic: " + topic)
+		}
+	}
+	return nil
+}
+
+/* paho tokens do not time out on their own */
+func wait(token mqtt.Token, what string) error {
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("%s timed out", what)
+	}
+	return token.Error()
+}
+
+/* subscriptions are lost with a clean session, so (re)subscribe on every connect */
+func (s *v3) onConnect(client mqtt.Client) {
+	s.opts.OnConnect()
+	if s.opts.StatusTopic != "" {
+		if err := s.Publish(s.opts.StatusTopic, []byte(Online), true); err != nil {
+			log.WithField("error", err).Warn("could not publish status")
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribed = make(map[string]byte)
+	topics := s.opts.topics()
+	token := client.SubscribeMultiple(topics, nil)
+	if token.Wait() && token.Error() != nil {
+		log.WithField("error", token.Error()).Error("could not subscribe to topics")
+		return
+	}
+	for topic, qos := range topics {
+		s.subscribed[topic] = qos
+		log.Info("Subscribed to topic: " + topic)
+	}
+}
@@ -0,0 +1,192 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	log "github.com/sirupsen/logrus"
+)
+
+// v5 speaks MQTT v5 through paho.golang, which adds shared subscriptions and message expiry
+type v5 struct {
+	opts   Options
+	config autopaho.ClientConfig
+	cm     *autopaho.ConnectionManager
+
+	mutex      sync.Mutex
+	subscribed map[string]byte // since the last connect
+}
+
+func newV5(opts Options, tlsConfig *tls.Config) (*v5, error) {
+	s := &v5{opts: opts}
+	c := opts.Config
+
+	broker, err := url.Parse(c.BrokerURL())
+	if err != nil {
+		return nil, err
+	}
+	s.config = autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{broker},
+		TlsCfg:            tlsConfig,
+		KeepAlive:         30,
+		ConnectRetryDelay: time.Second * time.Duration(c.ReconnectInterval),
+		OnConnectionUp:    s.onConnect,
+		OnConnectError: func(err error) {
+			log.WithField("error", err).Warn("could not connect to MQTT server")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: opts.ClientID,
+			Router:   paho.NewSingleHandlerRouter(s.onPublish),
+			OnClientError: func(err error) {
+				opts.OnConnectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				reason := "disconnected by server"
+				if d.Properties != nil && d.Properties.ReasonString != "" {
+					reason = d.Properties.ReasonString
+				}
+				opts.OnConnectionLost(&disconnectError{code: d.ReasonCode, reason: reason})
+			},
+		},
+	}
+	s.config.SetUsernamePassword(c.User, []byte(c.Password))
+	if opts.StatusTopic != "" {
+		s.config.SetWillMessage(opts.StatusTopic, []byte(Offline), 1, true)
+	}
+	return s, nil
+}
+
+func (s *v5) Connect(ctx context.Context) {
+	// the connection lives until Disconnect, ctx only limits the wait for the first connection
+	cm, err := autopaho.NewConnection(context.Background(), s.config)
+	if err != nil {
+		log.WithField("error", err).Error("could not start MQTT connection")
+		return
+	}
+	s.mutex.Lock()
+	s.cm = cm
+	s.mutex.Unlock()
+	// autopaho retries on its own, wait for the first connection like v3 does
+	if err := cm.AwaitConnection(ctx); err != nil {
+		return
+	}
+}
+
+func (s *v5) Disconnect() {
+	if s.cm == nil {
+		return
+	}
+	// the Last Will is not sent on a clean disconnect
+	if s.opts.StatusTopic != "" {
+		if err := s.Publish(s.opts.StatusTopic, []byte(Offline), true); err != nil {
+			log.WithField("error", err).Warn("could not publish status")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	s.cm.Disconnect(ctx)
+}
+
+func (s *v5) Publish(topic string, payload []byte, retain bool) error {
+	if s.cm == nil {
+		return autopaho.ConnectionDownError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.cm.Publish(ctx, &paho.Publish{Topic: topic, QoS: 1, Retain: retain, Payload: payload})
+	return err
+}
+
+func (s *v5) Resubscribe() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cm == nil || s.subscribed == nil {
+		// everything is subscribed on the first connect
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	subscribe, unsubscribe := diff(s.subscribed, s.opts.topics())
+	if len(unsubscribe) > 0 {
+		if _, err := s.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: unsubscribe}); err != nil {
+			return ignoreConnectionDown(err)
+		}
+		for _, topic := range unsubscribe {
+			delete(s.subscribed, topic)
+			log.Info("Unsubscribed from topic: " + topic)
+		}
+	}
+	if len(subscribe) > 0 {
+		sub := &paho.Subscribe{Subscriptions: make(map[string]paho.SubscribeOptions)}
+		for topic, qos := range subscribe {
+			sub.Subscriptions[topic] = paho.SubscribeOptions{QoS: qos}
+		}
+		if _, err := s.cm.Subscribe(ctx, sub); err != nil {
+			return ignoreConnectionDown(err)
+		}
+		for topic, qos := range subscribe {
+			s.subscribed[topic] = qos
+			log.Info("Subscribed to topic: " + topic)
+		}
+	}
+	return nil
+}
+
+/* while the connection is down there is nothing to change, everything is subscribed on the next connect */
+func ignoreConnectionDown(err error) error {
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return nil
+	}
+	return err
+}
+
+func (s *v5) onConnect(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+	s.opts.OnConnect()
+	if s.opts.StatusTopic != "" {
+		_, err := cm.Publish(context.Background(), &paho.Publish{Topic: s.opts.StatusTopic, QoS: 1, Retain: true, Payload: []byte(Online)})
+		if err != nil {
+			log.WithField("error", err).Warn("could not publish status")
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribed = make(map[string]byte)
+	topics := s.opts.topics()
+	sub := &paho.Subscribe{Subscriptions: make(map[string]paho.SubscribeOptions)}
+	for topic, qos := range topics {
+		sub.Subscriptions[topic] = paho.SubscribeOptions{QoS: qos}
+	}
+	if _, err := cm.Subscribe(context.Background(), sub); err != nil {
+		log.WithField("error", err).Error("could not subscribe to topics")
+		return
+	}
+	for topic, qos := range topics {
+		s.subscribed[topic] = qos
+		log.Info("Subscribed to topic: " + topic)
+	}
+}
+
+/* the broker sends the remaining expiry interval, the message expires that many seconds after it arrived */
+func (s *v5) onPublish(p *paho.Publish) {
+	msg := Message{Topic: p.Topic, Payload: p.Payload}
+	if p.Properties != nil && p.Properties.MessageExpiry != nil {
+		msg.Expires = time.Now().Add(time.Second * time.Duration(*p.Properties.MessageExpiry))
+	}
+	s.opts.OnMessage(msg)
+}
+
+type disconnectError struct {
+	code   byte
+	reason string
+}
+
+func (e *disconnectError) Error() string {
+	return fmt.Sprintf("%s (reason code %d)", e.reason, e.code)
+}